@@ -0,0 +1,25 @@
+package certificate
+
+import (
+	"net"
+	"net/http"
+)
+
+// RedirectHandler - sends plain http requests to https on port of tlsAddress
+func RedirectHandler(tlsAddress string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddress)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
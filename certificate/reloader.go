@@ -0,0 +1,153 @@
+package certificate
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+const defaultCheckPeriod = 30 * time.Second
+
+// Reloader - keeps certificate loaded from disk and reloads it
+// on SIGHUP or when files are changed
+type Reloader struct {
+	certFile    string
+	keyFile     string
+	checkPeriod time.Duration
+	mu          sync.RWMutex
+	cert        *tls.Certificate
+	modTime     time.Time
+	stop        chan struct{}
+	wg          sync.WaitGroup
+	once        sync.Once
+}
+
+// NewReloader - load certificate and key pair from files
+func NewReloader(certFile string, keyFile string) (*Reloader, error) {
+	reloader := new(Reloader)
+	reloader.certFile = certFile
+	reloader.keyFile = keyFile
+	reloader.checkPeriod = defaultCheckPeriod
+	reloader.stop = make(chan struct{})
+
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+// Reload - read certificate from disk, current one is kept on error
+func (reloader *Reloader) Reload() error {
+	modTime := reloader.filesModTime()
+	cert, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+
+	if err != nil {
+		return err
+	}
+
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+
+	reloader.cert = &cert
+	reloader.modTime = modTime
+
+	return nil
+}
+
+// GetCertificate - for tls.Config
+func (reloader *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mu.RLock()
+	defer reloader.mu.RUnlock()
+
+	return reloader.cert, nil
+}
+
+// Start - watch for SIGHUP and file changes in background
+func (reloader *Reloader) Start() {
+	hup := make(chan os.Signal, 1)
+
+	if len(reloadSignals) > 0 {
+		signal.Notify(hup, reloadSignals...)
+	}
+	reloader.wg.Add(1)
+
+	go func() {
+		defer reloader.wg.Done()
+		defer signal.Stop(hup)
+
+		ticker := time.NewTicker(reloader.checkPeriod)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-reloader.stop:
+				return
+			case <-hup:
+				reloader.reload("SIGHUP")
+			case <-ticker.C:
+				if reloader.isChanged() {
+					reloader.reload("files changed")
+				}
+			}
+		}
+	}()
+}
+
+// Stop - stop watching
+func (reloader *Reloader) Stop() {
+	reloader.once.Do(func() {
+		close(reloader.stop)
+	})
+	reloader.wg.Wait()
+}
+
+func (reloader *Reloader) reload(reason string) {
+	if err := reloader.Reload(); err != nil {
+		log.Println("reload certificate error:", err)
+		return
+	}
+
+	log.Println("certificate reloaded:", reason)
+}
+
+func (reloader *Reloader) isChanged() bool {
+	reloader.mu.RLock()
+	defer reloader.mu.RUnlock()
+
+	return !reloader.filesModTime().Equal(reloader.modTime)
+}
+
+// filesModTime - latest modification time of certificate and key
+func (reloader *Reloader) filesModTime() time.Time {
+	latest := time.Time{}
+
+	for _, name := range []string{reloader.certFile, reloader.keyFile} {
+		if info, err := os.Stat(name); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest
+}
+
+// Config - tls config with modern protocol versions and ciphers
+func (reloader *Reloader) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		GetCertificate:   reloader.GetCertificate,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+		PreferServerCipherSuites: true,
+	}
+}
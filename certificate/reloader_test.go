@@ -0,0 +1,95 @@
+package certificate
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeCert(t *testing.T, dir string, name string) (string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	return certFile, keyFile
+}
+
+func commonName(t *testing.T, reloader *Reloader) string {
+	cert, _ := reloader.GetCertificate(nil)
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed.Subject.CommonName
+}
+
+func TestReload(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cert")
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeCert(t, dir, "first")
+	reloader, err := NewReloader(certFile, keyFile)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "first", commonName(t, reloader))
+	assert.False(t, reloader.isChanged())
+
+	writeCert(t, dir, "second")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+
+	assert.True(t, reloader.isChanged())
+	assert.Nil(t, reloader.Reload())
+	assert.Equal(t, "second", commonName(t, reloader))
+
+	// broken files keep previous certificate
+	ioutil.WriteFile(certFile, []byte("broken"), 0600)
+	assert.NotNil(t, reloader.Reload())
+	assert.Equal(t, "second", commonName(t, reloader))
+}
+
+func TestRedirectHandler(t *testing.T) {
+	handler := RedirectHandler(":8443")
+	r := httptest.NewRequest(http.MethodGet, "http://example.com:8080/chats?page=1", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusPermanentRedirect, w.Code)
+	assert.Equal(t, "https://example.com:8443/chats?page=1", w.Header().Get("Location"))
+
+	handler = RedirectHandler(":443")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	assert.Equal(t, "https://example.com/chats?page=1", w.Header().Get("Location"))
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package certificate
+
+import (
+	"os"
+	"syscall"
+)
+
+var reloadSignals = []os.Signal{syscall.SIGHUP}
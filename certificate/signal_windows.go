@@ -0,0 +1,6 @@
+package certificate
+
+import "os"
+
+// there is no SIGHUP, certificate is reloaded on file change only
+var reloadSignals = []os.Signal{}
@@ -0,0 +1,110 @@
+package controller
+
+import (
+	"net/http"
+
+	"server/core/ewc"
+	"server/model/dao"
+	"server/service"
+)
+
+// permissions of chat members
+const (
+	permRead           = "read"
+	permPost           = "post"
+	permDeleteMessages = "delete_messages"
+	permRename         = "rename"
+	permManageMembers  = "manage_members"
+	permChangeTTL      = "change_ttl"
+	permClean          = "clean"
+	permManageRoles    = "manage_roles"
+	permDeleteChat     = "delete_chat"
+	permTransfer       = "transfer_ownership"
+)
+
+// rolePermissions - what every role can do in chat
+var rolePermissions = map[string][]string{
+	dao.RoleOwner: {
+		permRead, permPost, permDeleteMessages, permRename, permManageMembers,
+		permChangeTTL, permClean, permManageRoles, permDeleteChat, permTransfer,
+	},
+	dao.RoleAdmin: {
+		permRead, permPost, permDeleteMessages, permRename, permManageMembers,
+		permChangeTTL, permClean,
+	},
+	dao.RoleMember:   {permRead, permPost},
+	dao.RoleReadOnly: {permRead},
+}
+
+// roleRanks - members can only manage members of lower rank
+var roleRanks = map[string]int{
+	dao.RoleOwner:    3,
+	dao.RoleAdmin:    2,
+	dao.RoleMember:   1,
+	dao.RoleReadOnly: 0,
+}
+
+// can - role has permission
+func can(role string, permission string) bool {
+	for _, item := range rolePermissions[role] {
+		if item == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+// outranks - role can manage member with other role
+func outranks(role string, other string) bool {
+	return roleRanks[role] > roleRanks[other]
+}
+
+// chatAuth - authorization of chat and message handlers
+type chatAuth struct {
+	chatService *ewc.DbChatService
+	roleService *service.DbRoleService
+}
+
+func newChatAuth() *chatAuth {
+	auth := new(chatAuth)
+	auth.chatService = ewc.NewDbChatService()
+	auth.roleService = service.NewDbRoleService()
+
+	return auth
+}
+
+// authorize - chat where user has permission and role of user, otherwise error is written.
+// Missing chat is 404, chat of others is 403 not_member, missing permission is 403 no_permission.
+func (auth *chatAuth) authorize(w http.ResponseWriter, r *http.Request, chatID int64, userID int64,
+	permission string, includes ...string) (*ewc.Chat, string, bool) {
+	chat, err := auth.chatService.Get(chatID, includes)
+
+	if err != nil || chat == nil || chat.ID == 0 {
+		writeError(w, r, http.StatusNotFound, dao.CodeChatNotFound, "chat not found")
+		return nil, "", false
+	}
+	if !auth.chatService.IsUserInChat(chatID, userID) {
+		writeError(w, r, http.StatusForbidden, dao.CodeNotMember, "user is not a member of chat")
+		return nil, "", false
+	}
+
+	role := auth.roleService.Get(chat, userID)
+
+	if !checkPermission(w, r, role, permission) {
+		return nil, "", false
+	}
+
+	return chat, role, true
+}
+
+// checkPermission - role has permission, otherwise error is written.
+// For handlers which need more permissions depending on request.
+func checkPermission(w http.ResponseWriter, r *http.Request, role string, permission string) bool {
+	if !can(role, permission) {
+		writeError(w, r, http.StatusForbidden, dao.CodeNoPermission, role+" can't "+permission)
+		return false
+	}
+
+	return true
+}
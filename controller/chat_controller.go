@@ -1,21 +1,41 @@
 package controller
 
 import (
-	"encoding/json"
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"server/core/ewc"
+	"server/hub"
 	"server/model/dao"
+	"server/service"
+	"server/validation"
 
 	"github.com/gorilla/mux"
 )
 
+const (
+	defaultMinMessageTTL = 5
+	defaultMaxMessageTTL = 7 * 24 * 60 * 60
+	// invite links
+	defaultInviteLifeTime    = 7 * 24 * 60 * 60
+	defaultInviteMaxLifeTime = 30 * 24 * 60 * 60
+)
+
 type ChatCtrl struct {
-	config      *dao.Config
-	service     *ewc.DbChatService
-	userService *ewc.DbUserService
+	config          *dao.Config
+	service         *ewc.DbChatService
+	userService     *ewc.DbUserService
+	messageService  *ewc.DbMessageService
+	readService     *service.DbReadService
+	settingsService *service.DbChatSettingsService
+	memberService   *service.DbMemberService
+	inviteService   *service.DbInviteService
+	auth            *chatAuth
+	hub             *hub.Hub
+	limits          validation.Limits
+	now             func() time.Time
 }
 
 func NewChatCtrl(cfg *dao.Config) *ChatCtrl {
@@ -23,190 +43,950 @@ func NewChatCtrl(cfg *dao.Config) *ChatCtrl {
 	ctrl.config = cfg
 	ctrl.service = ewc.NewDbChatService()
 	ctrl.userService = ewc.NewDbUserService()
+	ctrl.messageService = ewc.NewDbMessageService()
+	ctrl.readService = service.NewDbReadService()
+	ctrl.settingsService = service.NewDbChatSettingsService()
+	ctrl.memberService = service.NewDbMemberService()
+	ctrl.inviteService = service.NewDbInviteService()
+	ctrl.auth = newChatAuth()
+	ctrl.hub = Hub
+	ctrl.limits = validation.NewLimits(cfg)
+	ctrl.now = time.Now
 
 	return ctrl
 }
 
 func (ctrl *ChatCtrl) GetList(w http.ResponseWriter, r *http.Request) {
-	claims := getClaims(r)
-	chats, err := ctrl.service.GetForUser(claims.Id)
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
 
-	// TODO: unread messages
+	chats, err := ctrl.service.GetForUser(claims.Id)
 
 	if err != nil {
 		log.Println("get chat list for user error:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
 		return
 	}
-	if err := json.NewEncoder(w).Encode(&chats); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+
+	chatData, err := ctrl.getUnreadCount(claims.Id, chats)
+
+	if err != nil {
+		log.Println("get unread count error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
 		return
 	}
+
+	writeJSON(w, http.StatusOK, &chatData)
 }
 
 func (ctrl *ChatCtrl) Get(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	claims := getClaims(r)
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
 	id, err := strconv.ParseInt(vars["id"], 10, 64)
 
 	if err != nil {
 		log.Println("parse id error:", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	if !ctrl.service.IsUserInChat(id, claims.Id) {
-		w.WriteHeader(http.StatusForbidden)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid chat id")
 		return
 	}
 
 	includes := getInclude(r.FormValue("include"))
-	chat, err := ctrl.service.Get(id, includes)
+	chat, role, ok := ctrl.auth.authorize(w, r, id, claims.Id, permRead, includes...)
 
-	if err := json.NewEncoder(w).Encode(chat); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	if !ok {
 		return
 	}
+
+	details := chatDetails(chat, ctrl.settingsService.Get(id), role)
+
+	if hasInclude(includes, "read_state") {
+		details.ReadState = ctrl.readService.GetChatCursors(id)
+	}
+	if hasInclude(includes, "roles") {
+		details.Roles = ctrl.auth.roleService.GetForChat(id)
+	}
+
+	w.Header().Set("ETag", chatETag(chat))
+	writeJSON(w, http.StatusOK, details)
 }
 
 func (ctrl *ChatCtrl) Create(w http.ResponseWriter, r *http.Request) {
-	claims := getClaims(r)
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
 
+	// looks like failure for account after login with reset password
 	if user := ctrl.userService.Get(claims.Id); user.Reseted {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
 		return
 	}
 
 	chat := ewc.Chat{}
 	isExist := false
 
-	if err := json.NewDecoder(r.Body).Decode(&chat); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	if !decodeBody(w, r, ctrl.limits.MaxBodyBytes, &chat) {
+		return
+	}
+
+	if fields := validation.Check(
+		validation.Rule{Field: "name", Value: chat.Name, Limit: ctrl.nameLimit(chat.Personal)},
+	); len(fields) > 0 {
+		writeFieldErrors(w, r, fields)
 		return
 	}
+	// id, owner and timestamps belong to server, users are taken as stored, not as sent
+	chat.ID = 0
+	chat.OwnerID = claims.Id
+	chat.UnreadMessages = 0
+	chat.CreatedAt = time.Time{}
+	chat.UpdatedAt = time.Time{}
+	users := make([]ewc.User, 0, len(chat.Users))
+
 	for _, user := range chat.Users {
+		stored := ctrl.userService.Get(user.ID)
+
+		if stored.ID == 0 {
+			writeFieldErrors(w, r, []dao.FieldError{{Field: "users", Code: dao.FieldInvalid, Message: "unknown user"}})
+			return
+		}
 		if user.ID == claims.Id {
 			isExist = true
 		}
+
+		users = append(users, stored)
 	}
 	if !isExist {
-		w.WriteHeader(http.StatusForbidden)
+		writeError(w, r, http.StatusForbidden, dao.CodeNotMember, "creator must be in users of chat")
 		return
 	}
 
+	chat.Users = users
+
 	item, err := ctrl.service.Create(chat)
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("create chat error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, item)
+}
+
+// Update - partial update of chat, fields missing in patch are kept.
+// If-Match with ETag of chat rejects update when chat was changed since.
+func (ctrl *ChatCtrl) Update(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+
+	if err != nil {
+		log.Println("parse id for update error:", err)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid chat id")
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
+	chat, role, ok := ctrl.auth.authorize(w, r, id, claims.Id, permRead)
 
-	if err := json.NewEncoder(w).Encode(item); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	if !ok {
 		return
 	}
+
+	patch := dao.ChatPatch{}
+
+	if !decodeBody(w, r, ctrl.limits.MaxBodyBytes, &patch) {
+		return
+	}
+	if patch.Name != nil || patch.Description != nil || patch.Avatar != nil {
+		if !checkPermission(w, r, role, permRename) {
+			return
+		}
+	}
+	if patch.MessageTTL != nil && !checkPermission(w, r, role, permChangeTTL) {
+		return
+	}
+
+	match := r.Header.Get("If-Match")
+
+	if match != "" && match != "*" && match != chatETag(chat) {
+		writeError(w, r, http.StatusPreconditionFailed, dao.CodePreconditionFailed, "chat was changed, get it again")
+		return
+	}
+
+	rules := make([]validation.Rule, 0)
+
+	if patch.Name != nil {
+		rules = append(rules, validation.Rule{Field: "name", Value: *patch.Name, Limit: ctrl.nameLimit(chat.Personal)})
+	}
+	if patch.Description != nil {
+		rules = append(rules, validation.Rule{Field: "description", Value: *patch.Description, Limit: ctrl.limits.ChatDescription})
+	}
+	if patch.Avatar != nil {
+		rules = append(rules, validation.Rule{Field: "avatar", Value: *patch.Avatar, Limit: ctrl.limits.Avatar})
+	}
+
+	fields := validation.Check(rules...)
+
+	if patch.MessageTTL != nil && !ctrl.isValidTTL(*patch.MessageTTL) {
+		fields = append(fields, dao.FieldError{
+			Field:   "message_ttl",
+			Code:    dao.FieldInvalid,
+			Message: "message ttl is out of allowed range",
+		})
+	}
+	if len(fields) > 0 {
+		writeFieldErrors(w, r, fields)
+		return
+	}
+
+	previous := ctrl.settingsService.Get(id)
+	settings := previous
+	name := patch.Name
+
+	if name != nil && *name == chat.Name {
+		name = nil
+	}
+	if patch.Description != nil {
+		settings.Description = *patch.Description
+	}
+	if patch.Avatar != nil {
+		settings.Avatar = *patch.Avatar
+	}
+	if patch.MessageTTL != nil {
+		settings.MessageTTL = *patch.MessageTTL
+	}
+	// nothing is changed, version is kept
+	if name == nil && settings == previous {
+		w.Header().Set("ETag", chatETag(chat))
+		writeJSON(w, http.StatusOK, chatDetails(chat, settings, role))
+		return
+	}
+	// chat read above is the version, concurrent update wins and this one fails
+	settings, err = ctrl.settingsService.Update(settings, name, chat.UpdatedAt)
+
+	switch {
+	case err == service.ErrVersionConflict && match != "":
+		writeError(w, r, http.StatusPreconditionFailed, dao.CodePreconditionFailed, "chat was changed, get it again")
+		return
+	case err == service.ErrVersionConflict:
+		writeError(w, r, http.StatusConflict, dao.CodeVersionConflict, "chat was changed, try again")
+		return
+	case err != nil:
+		log.Println("update chat error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+	if chat, err = ctrl.service.Get(id, []string{}); err != nil {
+		log.Println("get updated chat error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+
+	ctrl.hub.PublishToChat(dao.Event{
+		Type:   dao.EventChatUpdated,
+		ChatID: id,
+		Data:   chatDetails(chat, settings, ""),
+	})
+
+	if name != nil {
+		ctrl.addSystemMessage(id, ctrl.userService.Get(claims.Id).Login+" renamed chat to "+*name)
+	}
+	if settings.MessageTTL != previous.MessageTTL {
+		ctrl.addSystemMessage(id, ttlMessage(settings.MessageTTL))
+	}
+
+	w.Header().Set("ETag", chatETag(chat))
+	writeJSON(w, http.StatusOK, chatDetails(chat, settings, role))
 }
 
 func (ctrl *ChatCtrl) Delete(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := strconv.ParseInt(vars["id"], 10, 64)
-	claims := getClaims(r)
+	claims, ok := getClaims(w, r)
 
-	if err != nil {
-		log.Println("parse id for delete error:", err)
-		w.WriteHeader(http.StatusBadRequest)
+	if !ok {
 		return
 	}
-	if !ctrl.service.IsUserInChat(id, claims.Id) {
-		w.WriteHeader(http.StatusForbidden)
+
+	if err != nil {
+		log.Println("parse id for delete error:", err)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid chat id")
 		return
 	}
 
-	chat, err := ctrl.service.Get(id, []string{})
+	chat, _, ok := ctrl.auth.authorize(w, r, id, claims.Id, permDeleteChat)
 
-	if err != nil {
-		log.Println("get chat for delete error")
-		w.WriteHeader(http.StatusInternalServerError)
+	if !ok {
 		return
 	}
-	if !chat.Personal || chat.OwnerID != claims.Id {
-		w.WriteHeader(http.StatusForbidden)
+	if !chat.Personal {
+		writeError(w, r, http.StatusForbidden, dao.CodeForbidden, "only personal chat can be deleted")
 		return
 	}
 
 	ctrl.service.Delete(chat)
+
+	if err := ctrl.auth.roleService.DeleteForChat(id); err != nil {
+		log.Println("delete roles of chat error:", err)
+	}
 }
 
 func (ctrl *ChatCtrl) Exit(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	claims := getClaims(r)
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
 	id, err := strconv.ParseInt(vars["id"], 10, 64)
 
 	if err != nil {
 		log.Println("parse id for exit error:", err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid chat id")
+		return
+	}
+
+	chat, role, ok := ctrl.auth.authorize(w, r, id, claims.Id, permRead)
+
+	if !ok {
 		return
 	}
-	if !ctrl.service.IsUserInChat(id, claims.Id) {
-		w.WriteHeader(http.StatusForbidden)
+	// group chat without owner can't be managed anymore
+	if !chat.Personal && role == dao.RoleOwner {
+		writeError(w, r, http.StatusConflict, dao.CodeOwnerCantExit, "transfer ownership before exit")
+		return
+	}
+
+	// members are collected before exit so the leaving user gets the event too
+	recipients := ctrl.hub.Recipients(chat.ID)
+	ctrl.service.Exit(chat)
+
+	if err := ctrl.auth.roleService.Delete(id, claims.Id); err != nil {
+		log.Println("delete role of member error:", err)
+	}
+	ctrl.hub.Send(dao.Event{
+		Type:   dao.EventChatExited,
+		ChatID: chat.ID,
+		Data:   dao.ChatMemberRef{ChatID: chat.ID, UserID: claims.Id},
+	}, recipients)
+
+	if !chat.Personal {
+		ctrl.addSystemMessage(chat.ID, ctrl.userService.Get(claims.Id).Login+" left")
+	}
+}
+
+// AddMember - owner or admin adds friend to group chat
+func (ctrl *ChatCtrl) AddMember(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	claims, ok := getClaims(w, r)
+
+	if !ok {
 		return
 	}
 
-	chat, err := ctrl.service.Get(id, []string{})
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
 
 	if err != nil {
-		log.Println("get chat for exit error:", err)
-		w.WriteHeader(http.StatusNotFound)
+		log.Println("parse id for add member error:", err)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid chat id")
 		return
 	}
 
-	ctrl.service.Exit(chat)
+	chat, _, ok := ctrl.auth.authorize(w, r, id, claims.Id, permManageMembers)
+
+	if !ok || !checkGroupChat(w, r, chat) {
+		return
+	}
+
+	data := dao.MemberAddition{}
+
+	if !decodeBody(w, r, ctrl.limits.MaxBodyBytes, &data) {
+		return
+	}
+	if data.UserID <= 0 {
+		writeFieldErrors(w, r, []dao.FieldError{{Field: "user_id", Code: dao.FieldRequired}})
+		return
+	}
+
+	// like profiles, only friends are reachable
+	var friend *ewc.User
+
+	for _, item := range ctrl.userService.GetFriends(claims.Id) {
+		if item.ID == data.UserID {
+			friend = &item
+			break
+		}
+	}
+	if friend == nil {
+		writeError(w, r, http.StatusForbidden, dao.CodeNotFriend, "only friends can be added")
+		return
+	}
+	if ctrl.service.IsUserInChat(id, friend.ID) {
+		writeError(w, r, http.StatusConflict, dao.CodeAlreadyMember, "user is a member already")
+		return
+	}
+	if err := ctrl.memberService.Add(id, friend.ID); err != nil {
+		log.Println("add member error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+
+	member := dao.ChatMemberRef{ChatID: id, UserID: friend.ID}
+
+	ctrl.hub.PublishToChat(dao.Event{
+		Type:   dao.EventChatJoined,
+		ChatID: id,
+		Data:   member,
+	})
+	ctrl.addSystemMessage(id, ctrl.userService.Get(claims.Id).Login+" added "+friend.Login)
+	writeJSON(w, http.StatusCreated, member)
 }
 
-func (ctrl *ChatCtrl) Clean(w http.ResponseWriter, r *http.Request) {
+// CreateInvite - new invite link of group chat, token is returned only here
+func (ctrl *ChatCtrl) CreateInvite(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+
+	if err != nil {
+		log.Println("parse id for create invite error:", err)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid chat id")
+		return
+	}
+
+	chat, _, ok := ctrl.auth.authorize(w, r, id, claims.Id, permManageMembers)
+
+	if !ok || !checkGroupChat(w, r, chat) {
+		return
+	}
+
+	data := dao.InviteCreation{}
+
+	if !decodeBody(w, r, ctrl.limits.MaxBodyBytes, &data) {
+		return
+	}
+
+	lifeTime, maxLifeTime := ctrl.config.InviteLifeTime, ctrl.config.InviteMaxLifeTime
+
+	if maxLifeTime <= 0 {
+		maxLifeTime = defaultInviteMaxLifeTime
+	}
+	if lifeTime <= 0 {
+		lifeTime = defaultInviteLifeTime
+	}
+	if lifeTime > maxLifeTime {
+		lifeTime = maxLifeTime
+	}
+	if data.ExpiresIn == 0 {
+		data.ExpiresIn = lifeTime
+	}
+
+	var fields []dao.FieldError
+
+	if data.ExpiresIn < 0 || data.ExpiresIn > maxLifeTime {
+		fields = append(fields, dao.FieldError{
+			Field:   "expires_in",
+			Code:    dao.FieldInvalid,
+			Message: "must be from 1 to " + strconv.FormatInt(maxLifeTime, 10) + " seconds",
+		})
+	}
+	if data.MaxUses < 0 {
+		fields = append(fields, dao.FieldError{Field: "max_uses", Code: dao.FieldInvalid, Message: "must not be negative"})
+	}
+	if len(fields) > 0 {
+		writeFieldErrors(w, r, fields)
+		return
+	}
+
+	now := ctrl.now()
+	invite, err := ctrl.inviteService.Create(dao.ChatInvite{
+		ChatID:    id,
+		CreatedBy: claims.Id,
+		MaxUses:   data.MaxUses,
+		ExpiresAt: now.Add(time.Duration(data.ExpiresIn) * time.Second),
+		CreatedAt: now,
+	})
+
+	if err != nil {
+		log.Println("create invite error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, invite)
+}
+
+// GetInvites - invites of group chat with usage counters
+func (ctrl *ChatCtrl) GetInvites(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	claims := getClaims(r)
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
 	id, err := strconv.ParseInt(vars["id"], 10, 64)
 
 	if err != nil {
-		log.Println("parse id for clean error:", err)
-		w.WriteHeader(http.StatusBadRequest)
+		log.Println("parse id for get invites error:", err)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid chat id")
+		return
+	}
+
+	chat, _, ok := ctrl.auth.authorize(w, r, id, claims.Id, permManageMembers)
+
+	if !ok || !checkGroupChat(w, r, chat) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ctrl.inviteService.GetForChat(id))
+}
+
+// RevokeInvite - invite can't be accepted anymore, it stays in list with its counters
+func (ctrl *ChatCtrl) RevokeInvite(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+
+	if err != nil {
+		log.Println("parse id for revoke invite error:", err)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid chat id")
+		return
+	}
+
+	inviteID, err := strconv.ParseInt(vars["invite_id"], 10, 64)
+
+	if err != nil {
+		log.Println("parse invite id for revoke invite error:", err)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid invite id")
 		return
 	}
-	if !ctrl.service.IsUserInChat(id, claims.Id) {
-		w.WriteHeader(http.StatusForbidden)
+
+	chat, _, ok := ctrl.auth.authorize(w, r, id, claims.Id, permManageMembers)
+
+	if !ok || !checkGroupChat(w, r, chat) {
 		return
 	}
 
-	chat, err := ctrl.service.Get(id, []string{})
+	found, err := ctrl.inviteService.Revoke(id, inviteID, ctrl.now())
 
 	if err != nil {
-		log.Println("get chat for clean error:", err)
-		w.WriteHeader(http.StatusNotFound)
+		log.Println("revoke invite error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, dao.CodeInviteNotFound, "invite not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AcceptInvite - caller joins chat of invite, friendship with members is not needed
+func (ctrl *ChatCtrl) AcceptInvite(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	now := ctrl.now()
+	invite, err := ctrl.inviteService.GetByToken(vars["token"], now)
+
+	switch err {
+	case nil:
+	case service.ErrInviteNotFound:
+		writeError(w, r, http.StatusNotFound, dao.CodeInviteNotFound, "invite not found")
+		return
+	case service.ErrInviteExpired:
+		writeError(w, r, http.StatusGone, dao.CodeInviteExpired, err.Error())
+		return
+	default:
+		log.Println("get invite error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+
+	switch err := ctrl.inviteService.Accept(invite, claims.Id, now); err {
+	case nil:
+	case service.ErrAlreadyMember:
+		writeError(w, r, http.StatusConflict, dao.CodeAlreadyMember, err.Error())
+		return
+	case service.ErrInviteExpired:
+		writeError(w, r, http.StatusGone, dao.CodeInviteExpired, err.Error())
+		return
+	default:
+		log.Println("accept invite error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+
+	member := dao.ChatMemberRef{ChatID: invite.ChatID, UserID: claims.Id}
+
+	ctrl.hub.PublishToChat(dao.Event{
+		Type:   dao.EventChatJoined,
+		ChatID: invite.ChatID,
+		Data:   member,
+	})
+	ctrl.addSystemMessage(invite.ChatID, ctrl.userService.Get(claims.Id).Login+" joined via invite link")
+	writeJSON(w, http.StatusCreated, member)
+}
+
+// RemoveMember - remove member of lower role from group chat, owner can only exit
+func (ctrl *ChatCtrl) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+
+	if err != nil {
+		log.Println("parse id for remove member error:", err)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid chat id")
+		return
+	}
+
+	userID, err := strconv.ParseInt(vars["user_id"], 10, 64)
+
+	if err != nil {
+		log.Println("parse user id for remove member error:", err)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid user id")
+		return
+	}
+
+	chat, role, ok := ctrl.auth.authorize(w, r, id, claims.Id, permManageMembers)
+
+	if !ok || !checkGroupChat(w, r, chat) {
+		return
+	}
+	if memberRole := ctrl.auth.roleService.Get(chat, userID); !outranks(role, memberRole) {
+		writeError(w, r, http.StatusForbidden, dao.CodeNoPermission, role+" can't remove "+memberRole)
+		return
+	}
+
+	// removed user gets the event too
+	recipients := ctrl.hub.Recipients(id)
+	removed, err := ctrl.memberService.Remove(id, userID)
+
+	if err != nil {
+		log.Println("remove member error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+	if !removed {
+		writeError(w, r, http.StatusNotFound, dao.CodeMemberNotFound, "user is not a member of chat")
+		return
+	}
+	if err := ctrl.auth.roleService.Delete(id, userID); err != nil {
+		log.Println("delete role of member error:", err)
+	}
+
+	ctrl.hub.Send(dao.Event{
+		Type:   dao.EventChatExited,
+		ChatID: id,
+		Data:   dao.ChatMemberRef{ChatID: id, UserID: userID},
+	}, recipients)
+	ctrl.addSystemMessage(id, ctrl.userService.Get(claims.Id).Login+" removed "+ctrl.userService.Get(userID).Login)
+}
+
+// SetRole - owner changes role of group chat member, owner role is only transferred
+func (ctrl *ChatCtrl) SetRole(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+
+	if err != nil {
+		log.Println("parse id for set role error:", err)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid chat id")
+		return
+	}
+
+	userID, err := strconv.ParseInt(vars["user_id"], 10, 64)
+
+	if err != nil {
+		log.Println("parse user id for set role error:", err)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid user id")
+		return
+	}
+
+	chat, _, ok := ctrl.auth.authorize(w, r, id, claims.Id, permManageRoles)
+
+	if !ok || !checkGroupChat(w, r, chat) {
+		return
+	}
+
+	data := dao.RoleChange{}
+
+	if !decodeBody(w, r, ctrl.limits.MaxBodyBytes, &data) {
+		return
+	}
+	if data.Role != dao.RoleAdmin && data.Role != dao.RoleMember && data.Role != dao.RoleReadOnly {
+		writeFieldErrors(w, r, []dao.FieldError{{
+			Field:   "role",
+			Code:    dao.FieldInvalid,
+			Message: "role must be admin, member or read_only",
+		}})
+		return
+	}
+	if !ctrl.service.IsUserInChat(id, userID) {
+		writeError(w, r, http.StatusNotFound, dao.CodeMemberNotFound, "user is not a member of chat")
+		return
+	}
+	if userID == chat.OwnerID {
+		writeError(w, r, http.StatusForbidden, dao.CodeForbidden, "owner role is changed by transfer")
+		return
+	}
+	if err := ctrl.auth.roleService.Set(id, userID, data.Role); err != nil {
+		log.Println("set role error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+
+	member := dao.ChatMemberRef{ChatID: id, UserID: userID, Role: data.Role}
+
+	ctrl.hub.PublishToChat(dao.Event{
+		Type:   dao.EventRoleChanged,
+		ChatID: id,
+		Data:   member,
+	})
+	writeJSON(w, http.StatusOK, member)
+}
+
+// TransferOwnership - owner gives chat to other member and becomes admin
+func (ctrl *ChatCtrl) TransferOwnership(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+
+	if err != nil {
+		log.Println("parse id for transfer error:", err)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid chat id")
+		return
+	}
+
+	chat, _, ok := ctrl.auth.authorize(w, r, id, claims.Id, permTransfer)
+
+	if !ok || !checkGroupChat(w, r, chat) {
+		return
+	}
+
+	data := dao.OwnerTransfer{}
+
+	if !decodeBody(w, r, ctrl.limits.MaxBodyBytes, &data) {
+		return
+	}
+	if data.UserID <= 0 || data.UserID == claims.Id {
+		writeFieldErrors(w, r, []dao.FieldError{{
+			Field:   "user_id",
+			Code:    dao.FieldInvalid,
+			Message: "new owner must be other member",
+		}})
+		return
+	}
+	if !ctrl.service.IsUserInChat(id, data.UserID) {
+		writeError(w, r, http.StatusNotFound, dao.CodeMemberNotFound, "user is not a member of chat")
+		return
+	}
+	switch err := ctrl.auth.roleService.TransferOwnership(id, claims.Id, data.UserID); err {
+	case nil:
+	case service.ErrNotOwner:
+		// ownership was transferred by concurrent request
+		writeError(w, r, http.StatusForbidden, dao.CodeNoPermission, err.Error())
+		return
+	default:
+		log.Println("transfer ownership error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+
+	for _, member := range []dao.ChatMemberRef{
+		{ChatID: id, UserID: data.UserID, Role: dao.RoleOwner},
+		{ChatID: id, UserID: claims.Id, Role: dao.RoleAdmin},
+	} {
+		ctrl.hub.PublishToChat(dao.Event{
+			Type:   dao.EventRoleChanged,
+			ChatID: id,
+			Data:   member,
+		})
+	}
+	ctrl.addSystemMessage(id, ctrl.userService.Get(claims.Id).Login+" made "+
+		ctrl.userService.Get(data.UserID).Login+" owner")
+}
+
+func (ctrl *ChatCtrl) Clean(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+
+	if err != nil {
+		log.Println("parse id for clean error:", err)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid chat id")
+		return
+	}
+
+	chat, _, ok := ctrl.auth.authorize(w, r, id, claims.Id, permClean)
+
+	if !ok {
 		return
 	}
 
 	ctrl.service.Clean(chat)
+	ctrl.hub.PublishToChat(dao.Event{
+		Type:   dao.EventChatCleaned,
+		ChatID: chat.ID,
+	})
+}
+
+// checkGroupChat - members of personal chat can't be changed, otherwise error is written
+func checkGroupChat(w http.ResponseWriter, r *http.Request, chat *ewc.Chat) bool {
+	if chat.Personal {
+		writeError(w, r, http.StatusForbidden, dao.CodeForbidden, "members of personal chat can't be changed")
+		return false
+	}
+
+	return true
 }
 
-func (ctrl *ChatCtrl) getUnreadCount(chats []*ewc.Chat) []dao.ChatData {
+func (ctrl *ChatCtrl) getUnreadCount(userID int64, chats []*ewc.Chat) ([]dao.ChatData, error) {
 	length := len(chats)
 	chatData := make([]dao.ChatData, 0, length)
 	chatIds := make([]int64, 0, length)
-	chatMap := make(map[int64]*ewc.Chat, length)
 
-	for i, chat := range chats {
-		chatIds[i] = chat.ID
-		chatMap[chat.ID] = chat
+	for _, chat := range chats {
+		chatIds = append(chatIds, chat.ID)
+	}
+
+	counts, err := ctrl.readService.GetUnreadCounts(userID, chatIds)
+
+	if err != nil {
+		return nil, err
+	}
+	for _, chat := range chats {
+		chatData = append(chatData, dao.ChatData{
+			Chat:        *chat,
+			UnreadCount: counts[chat.ID],
+		})
+	}
+
+	return chatData, nil
+}
+
+// nameLimit - name of personal chat may be empty, it's shown from other user
+func (ctrl *ChatCtrl) nameLimit(personal bool) validation.Limit {
+	if personal {
+		return ctrl.limits.ChatName.Optional()
 	}
 
-	query := `
-		select chats.id, count(messages.*)
-		join on messages on messages.chat_id = chats.id
-		where chats.id in (?) and messages.is_read = true
-	`
-	log.Println(query)
+	return ctrl.limits.ChatName
+}
+
+// chatETag - version of chat for If-Match, every update of chat moves its update time
+func chatETag(chat *ewc.Chat) string {
+	return `"` + strconv.FormatInt(chat.UpdatedAt.UnixNano(), 36) + `"`
+}
+
+// chatDetails - chat with options kept by server
+func chatDetails(chat *ewc.Chat, settings dao.ChatSettings, role string) dao.ChatDetails {
+	return dao.ChatDetails{
+		Chat:        *chat,
+		MessageTTL:  settings.MessageTTL,
+		Description: settings.Description,
+		Avatar:      settings.Avatar,
+		Role:        role,
+	}
+}
+
+// isValidTTL - zero turns ttl off, other values must be in config bounds
+func (ctrl *ChatCtrl) isValidTTL(ttl int64) bool {
+	if ttl == 0 {
+		return true
+	}
+
+	min, max := ctrl.config.MinMessageTTL, ctrl.config.MaxMessageTTL
+
+	if min <= 0 {
+		min = defaultMinMessageTTL
+	}
+	if max <= 0 {
+		max = defaultMaxMessageTTL
+	}
+
+	return ttl >= min && ttl <= max
+}
+
+// addSystemMessage - record service message in chat and push it to members
+func (ctrl *ChatCtrl) addSystemMessage(chatID int64, text string) {
+	now := time.Now()
+	msg, err := ctrl.messageService.Create(ewc.Message{
+		UserID:    dao.SystemUserID,
+		ChatID:    chatID,
+		Text:      text,
+		CreatedAt: now,
+		UpdatedAt: now,
+	})
+
+	if err != nil {
+		log.Println("create system message error:", err)
+		return
+	}
+
+	ctrl.hub.PublishToChat(dao.Event{
+		Type:   dao.EventMessageCreated,
+		ChatID: chatID,
+		Data:   msg,
+	})
+}
+
+func ttlMessage(ttl int64) string {
+	if ttl == 0 {
+		return "Disappearing messages turned off"
+	}
 
-	return chatData
+	return "Disappearing messages set to " + (time.Duration(ttl) * time.Second).String()
 }
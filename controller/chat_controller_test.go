@@ -1,6 +1,7 @@
 package controller
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -14,9 +15,12 @@ import (
 	"time"
 
 	"server/core/ewc"
+	"server/middleware"
 	"server/model/dao"
+	"server/service"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"github.com/joho/godotenv"
@@ -55,6 +59,8 @@ func setupChats() {
 		DbDriver:         driver,
 		ConnectionString: connectionString,
 	})
+	service.Setup(cfg)
+	middleware.Setup(cfg)
 
 	db := getDb()
 	db.AutoMigrate(&ewc.Message{})
@@ -239,6 +245,25 @@ func TestCreate(t *testing.T) {
 	for _, user := range chat.Users {
 		assert.Equal(t, goodId, user.ID)
 	}
+
+	// id, owner and timestamps are set by server, unknown users are rejected
+	body, _ = json.Marshal(ewc.Chat{
+		ID:        1,
+		OwnerID:   goodId + 1,
+		Name:      "new chat",
+		CreatedAt: time.Now().Add(-time.Hour),
+		Users:     []ewc.User{{ID: goodId}},
+	})
+	status, body = createMResponse(http.MethodPost, "http://localhost/chats", nil, body, ctrl.Create)
+	assert.Equal(t, http.StatusCreated, status)
+	json.Unmarshal(body, &chat)
+	assert.NotEqual(t, int64(1), chat.ID)
+	assert.Equal(t, goodId, chat.OwnerID)
+	assert.True(t, chat.CreatedAt.After(time.Now().Add(-time.Minute)))
+
+	body, _ = json.Marshal(ewc.Chat{Name: "new chat", Users: []ewc.User{{ID: goodId}, {ID: 100000}}})
+	status, _ = createMResponse(http.MethodPost, "http://localhost/chats", nil, body, ctrl.Create)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
 }
 
 func TestDelete(t *testing.T) {
@@ -255,3 +280,471 @@ func TestDelete(t *testing.T) {
 	status, _ = createMResponse(http.MethodGet, "http://localhost/chats/1", ps, nil, ctrl.Get)
 	assert.Equal(t, http.StatusNotFound, status)
 }
+
+func TestGetListUnread(t *testing.T) {
+	setupChats()
+	defer os.Remove(connectionString)
+
+	db := getDb()
+	otherId := goodId + 1
+
+	for i := 0; i < 3; i++ {
+		db.Save(&ewc.Message{
+			UserID: otherId,
+			ChatID: goodId,
+			Text:   "unread",
+		})
+	}
+	db.Close()
+
+	ctrl := NewChatCtrl(cfg)
+	status, body := createMResponse(http.MethodGet, "http://localhost/chats", nil, nil, ctrl.GetList)
+	chats := make([]dao.ChatData, 0)
+
+	assert.Equal(t, http.StatusOK, status)
+
+	if err := json.Unmarshal(body, &chats); err != nil {
+		assert.Failf(t, "invalid body: %s", string(body))
+		return
+	}
+
+	for _, chat := range chats {
+		if chat.ID == goodId {
+			assert.Equal(t, 3, chat.UnreadCount)
+		} else {
+			assert.Equal(t, 0, chat.UnreadCount)
+		}
+	}
+}
+
+func TestUpdateMessageTTL(t *testing.T) {
+	setupChats()
+	defer os.Remove(connectionString)
+
+	ctrl := NewChatCtrl(cfg)
+	ps := map[string]string{
+		"id": "1",
+	}
+	body, _ := json.Marshal(map[string]int64{"message_ttl": 3600})
+	status, body := createMResponse(http.MethodPatch, "http://localhost/chats/1", ps, body, ctrl.Update)
+	chat := dao.ChatDetails{}
+
+	assert.Equal(t, http.StatusOK, status)
+
+	if err := json.Unmarshal(body, &chat); err != nil {
+		assert.Failf(t, "invalid body: %s", string(body))
+		return
+	}
+
+	assert.Equal(t, int64(3600), chat.MessageTTL)
+
+	// ttl applied to new messages
+	msgCtrl := NewMessageCtrl(cfg)
+	body, _ = json.Marshal(ewc.Message{UserID: goodId, ChatID: goodId, Text: "msg text"})
+	status, body = createMResponse(http.MethodPost, "http://localhost/messages", nil, body, msgCtrl.Create)
+	msg := ewc.Message{}
+	json.Unmarshal(body, &msg)
+
+	assert.Equal(t, http.StatusCreated, status)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), msg.ExpiredAt, time.Minute)
+
+	// out of bounds
+	body, _ = json.Marshal(map[string]int64{"message_ttl": 1})
+	status, _ = createMResponse(http.MethodPatch, "http://localhost/chats/1", ps, body, ctrl.Update)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+}
+
+func TestMembers(t *testing.T) {
+	setupChats()
+	defer os.Remove(connectionString)
+
+	db := getDb()
+	db.AutoMigrate(&ewc.Friend{})
+	db.Save(&ewc.Friend{UserID: goodId, FriendID: 3})
+	db.Close()
+
+	ctrl := NewChatCtrl(cfg)
+	ps := map[string]string{
+		"id": "2",
+	}
+	addMember := func(ps map[string]string, userID int64) (int, dao.ApiError) {
+		body, _ := json.Marshal(dao.MemberAddition{UserID: userID})
+		status, body := createMResponse(http.MethodPost, "http://localhost/chats/2/members", ps, body, ctrl.AddMember)
+		apiErr := dao.ApiError{}
+		json.Unmarshal(body, &apiErr)
+
+		return status, apiErr
+	}
+
+	status, _ := addMember(ps, 3)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.True(t, ctrl.service.IsUserInChat(2, 3))
+
+	// owner is a member without row, hub gets all members by one query
+	memberIDs, err := ctrl.memberService.MemberIDs(2)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []int64{goodId, 2, 3}, memberIDs)
+
+	status, apiErr := addMember(ps, 3)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Equal(t, dao.CodeAlreadyMember, apiErr.Code)
+
+	// only friends
+	status, apiErr = addMember(ps, 4)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, dao.CodeNotFriend, apiErr.Code)
+	assert.False(t, ctrl.service.IsUserInChat(2, 4))
+
+	// personal chat
+	status, _ = addMember(map[string]string{"id": "1"}, 3)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	removeMember := func(userID string) int {
+		ps := map[string]string{"id": "2", "user_id": userID}
+		status, _ := createMResponse(http.MethodDelete, "http://localhost/chats/2/members/"+userID, ps, nil, ctrl.RemoveMember)
+
+		return status
+	}
+
+	assert.Equal(t, http.StatusForbidden, removeMember("1"))
+	assert.Equal(t, http.StatusOK, removeMember("3"))
+	assert.False(t, ctrl.service.IsUserInChat(2, 3))
+	assert.Equal(t, http.StatusNotFound, removeMember("3"))
+
+	// members see what happened
+	messages := make([]ewc.Message, 0)
+	db = getDb()
+	db.Where("chat_id = ? AND user_id = ?", 2, dao.SystemUserID).Order("id").Find(&messages)
+	db.Close()
+
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, "login_0 added login_2", messages[0].Text)
+		assert.Equal(t, "login_0 removed login_2", messages[1].Text)
+	}
+}
+
+func TestInvites(t *testing.T) {
+	setupChats()
+	defer os.Remove(connectionString)
+
+	ctrl := NewChatCtrl(cfg)
+	ps := map[string]string{"id": "2"}
+	createInvite := func(userID int64, ps map[string]string, data dao.InviteCreation) (int, dao.InviteData) {
+		body, _ := json.Marshal(data)
+		status, body := createUserResponse(userID, http.MethodPost, "http://localhost/chats/2/invites", ps, body, ctrl.CreateInvite)
+		invite := dao.InviteData{}
+		json.Unmarshal(body, &invite)
+
+		return status, invite
+	}
+	accept := func(userID int64, token string) (int, dao.ApiError) {
+		ps := map[string]string{"token": token}
+		status, body := createUserResponse(userID, http.MethodPost, "http://localhost/invites/"+token+"/accept", ps, nil, ctrl.AcceptInvite)
+		apiErr := dao.ApiError{}
+		json.Unmarshal(body, &apiErr)
+
+		return status, apiErr
+	}
+
+	status, invite := createInvite(goodId, ps, dao.InviteCreation{MaxUses: 2})
+	assert.Equal(t, http.StatusCreated, status)
+	assert.NotEmpty(t, invite.Token)
+	assert.WithinDuration(t, time.Now().Add(defaultInviteLifeTime*time.Second), invite.ExpiresAt, time.Minute)
+
+	// plain members can't invite, personal chats can't have invites
+	status, _ = createInvite(2, ps, dao.InviteCreation{})
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = createInvite(goodId, map[string]string{"id": "1"}, dao.InviteCreation{})
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = createInvite(goodId, ps, dao.InviteCreation{ExpiresIn: defaultInviteMaxLifeTime + 1, MaxUses: -1})
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+
+	// friendship is not needed, invite is used up after max uses
+	status, _ = accept(3, invite.Token)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.True(t, ctrl.service.IsUserInChat(2, 3))
+
+	status, apiErr := accept(3, invite.Token)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Equal(t, dao.CodeAlreadyMember, apiErr.Code)
+	status, apiErr = accept(goodId, invite.Token)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Equal(t, dao.CodeAlreadyMember, apiErr.Code)
+
+	// members can't be added twice even if both joins pass membership check
+	assert.Error(t, getDb().Create(&ewc.ChatUser{ChatID: 2, UserID: 3}).Error)
+
+	status, _ = accept(4, invite.Token)
+	assert.Equal(t, http.StatusCreated, status)
+	status, apiErr = accept(5, invite.Token)
+	assert.Equal(t, http.StatusGone, status)
+	assert.Equal(t, dao.CodeInviteExpired, apiErr.Code)
+	assert.False(t, ctrl.service.IsUserInChat(2, 5))
+
+	status, apiErr = accept(5, "unknown")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, dao.CodeInviteNotFound, apiErr.Code)
+
+	// expired invite
+	_, expiring := createInvite(goodId, ps, dao.InviteCreation{ExpiresIn: 60})
+	ctrl.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	status, _ = accept(5, expiring.Token)
+	assert.Equal(t, http.StatusGone, status)
+	ctrl.now = time.Now
+
+	// revoked invite stays in list with its counters
+	_, revoked := createInvite(goodId, ps, dao.InviteCreation{})
+	revokeInvite := func(id int64) int {
+		ps := map[string]string{"id": "2", "invite_id": strconv.FormatInt(id, 10)}
+		status, _ := createMResponse(http.MethodDelete, "http://localhost/chats/2/invites", ps, nil, ctrl.RevokeInvite)
+
+		return status
+	}
+
+	assert.Equal(t, http.StatusNoContent, revokeInvite(revoked.ID))
+	assert.Equal(t, http.StatusNotFound, revokeInvite(revoked.ID+100))
+	status, _ = accept(5, revoked.Token)
+	assert.Equal(t, http.StatusGone, status)
+
+	status, body := createMResponse(http.MethodGet, "http://localhost/chats/2/invites", ps, nil, ctrl.GetInvites)
+	invites := make([]dao.ChatInvite, 0)
+	json.Unmarshal(body, &invites)
+	assert.Equal(t, http.StatusOK, status)
+
+	if assert.Len(t, invites, 3) {
+		assert.Equal(t, revoked.ID, invites[0].ID)
+		assert.NotNil(t, invites[0].RevokedAt)
+		assert.Equal(t, invite.ID, invites[2].ID)
+		assert.Equal(t, 2, invites[2].Uses)
+		assert.Contains(t, string(body), `"uses":2`)
+		assert.NotContains(t, string(body), invite.Token)
+	}
+
+	// members see who joined
+	messages := make([]ewc.Message, 0)
+	db := getDb()
+	db.Where("chat_id = ? AND user_id = ?", 2, dao.SystemUserID).Order("id").Find(&messages)
+	db.Close()
+
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, "login_2 joined via invite link", messages[0].Text)
+	}
+
+	// storage failures are not reported as expired invites
+	_, failing := createInvite(goodId, ps, dao.InviteCreation{})
+	db = getDb()
+	db.Exec("CREATE TRIGGER no_accept BEFORE UPDATE ON chat_invites BEGIN SELECT RAISE(ABORT, 'no accept'); END")
+	db.Close()
+	status, apiErr = accept(5, failing.Token)
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.Equal(t, dao.CodeInternal, apiErr.Code)
+
+	db = getDb()
+	db.DropTable(&dao.ChatInvite{})
+	db.Close()
+	status, apiErr = accept(5, failing.Token)
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.Equal(t, dao.CodeInternal, apiErr.Code)
+}
+
+func TestRoles(t *testing.T) {
+	setupChats()
+	defer os.Remove(connectionString)
+
+	db := getDb()
+	db.Save(&ewc.ChatUser{ChatID: 2, UserID: goodId})
+	db.Save(&ewc.ChatUser{ChatID: 2, UserID: 3})
+	db.Save(&ewc.ChatUser{ChatID: 2, UserID: 4})
+	db.Close()
+
+	ctrl := NewChatCtrl(cfg)
+	msgCtrl := NewMessageCtrl(cfg)
+	setRole := func(userID int64, member string, role string) (int, dao.ApiError) {
+		ps := map[string]string{"id": "2", "user_id": member}
+		body, _ := json.Marshal(dao.RoleChange{Role: role})
+		status, body := createUserResponse(userID, http.MethodPut, "http://localhost/chats/2/members/"+member+"/role", ps, body, ctrl.SetRole)
+		apiErr := dao.ApiError{}
+		json.Unmarshal(body, &apiErr)
+
+		return status, apiErr
+	}
+	post := func(userID int64) int {
+		body, _ := json.Marshal(ewc.Message{UserID: userID, ChatID: 2, Text: "msg text"})
+		status, _ := createUserResponse(userID, http.MethodPost, "http://localhost/messages", nil, body, msgCtrl.Create)
+
+		return status
+	}
+
+	status, _ := setRole(goodId, "2", dao.RoleAdmin)
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = setRole(goodId, "3", dao.RoleReadOnly)
+	assert.Equal(t, http.StatusOK, status)
+
+	status, apiErr := setRole(goodId, "3", dao.RoleOwner)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.Equal(t, "role", apiErr.Fields[0].Field)
+
+	// only owner manages roles
+	status, apiErr = setRole(2, "4", dao.RoleAdmin)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, dao.CodeNoPermission, apiErr.Code)
+
+	ps := map[string]string{"id": "2"}
+	status, body := createUserResponse(2, http.MethodGet, "http://localhost/chats/2?include=roles", ps, nil, ctrl.Get)
+	details := dao.ChatDetails{}
+	json.Unmarshal(body, &details)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, dao.RoleAdmin, details.Role)
+	assert.Len(t, details.Roles, 2)
+
+	// read-only member reads, but doesn't post
+	assert.Equal(t, http.StatusCreated, post(4))
+	assert.Equal(t, http.StatusForbidden, post(3))
+	status, _ = createUserResponse(3, http.MethodGet, "http://localhost/chats/2", ps, nil, ctrl.Get)
+	assert.Equal(t, http.StatusOK, status)
+
+	// admin deletes messages of others, member doesn't
+	deleteMessage := func(userID int64, id int64) int {
+		ps := map[string]string{"id": strconv.FormatInt(id, 10)}
+		status, _ := createUserResponse(userID, http.MethodDelete, "http://localhost/messages/1", ps, nil, msgCtrl.Delete)
+
+		return status
+	}
+	firstID := int64(chatCount + 1)
+	assert.Equal(t, http.StatusForbidden, deleteMessage(4, firstID))
+	assert.Equal(t, http.StatusOK, deleteMessage(2, firstID))
+
+	// admin removes members, not other admins or owner
+	removeMember := func(userID int64, member string) int {
+		ps := map[string]string{"id": "2", "user_id": member}
+		status, _ := createUserResponse(userID, http.MethodDelete, "http://localhost/chats/2/members/"+member, ps, nil, ctrl.RemoveMember)
+
+		return status
+	}
+	assert.Equal(t, http.StatusForbidden, removeMember(2, "1"))
+	assert.Equal(t, http.StatusOK, removeMember(2, "3"))
+	assert.Equal(t, http.StatusForbidden, removeMember(4, "2"))
+
+	// ownership transfer
+	transfer := func(userID int64, newOwner int64) int {
+		body, _ := json.Marshal(dao.OwnerTransfer{UserID: newOwner})
+		status, _ := createUserResponse(userID, http.MethodPut, "http://localhost/chats/2/owner", ps, body, ctrl.TransferOwnership)
+
+		return status
+	}
+	exit := func(userID int64) int {
+		status, _ := createUserResponse(userID, http.MethodDelete, "http://localhost/chats/2/exit", ps, nil, ctrl.Exit)
+
+		return status
+	}
+
+	// owner stays until ownership is transferred
+	assert.Equal(t, http.StatusConflict, exit(goodId))
+	assert.True(t, ctrl.service.IsUserInChat(2, goodId))
+
+	assert.Equal(t, http.StatusForbidden, transfer(2, 4))
+	assert.Equal(t, http.StatusOK, transfer(goodId, 4))
+
+	status, body = createUserResponse(4, http.MethodGet, "http://localhost/chats/2", ps, nil, ctrl.Get)
+	details = dao.ChatDetails{}
+	json.Unmarshal(body, &details)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, int64(4), details.OwnerID)
+	assert.Equal(t, dao.RoleOwner, details.Role)
+
+	status, body = createMResponse(http.MethodGet, "http://localhost/chats/2", ps, nil, ctrl.Get)
+	details = dao.ChatDetails{}
+	json.Unmarshal(body, &details)
+	assert.Equal(t, dao.RoleAdmin, details.Role)
+
+	assert.Equal(t, http.StatusOK, exit(goodId))
+	assert.Equal(t, http.StatusConflict, exit(4))
+}
+
+func TestPatchChat(t *testing.T) {
+	setupChats()
+	defer os.Remove(connectionString)
+
+	ctrl := NewChatCtrl(cfg)
+	ps := map[string]string{
+		"id": "2",
+	}
+	request := func(userID int64, method string, body []byte, ifMatch string, handler http.HandlerFunc) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "http://localhost/chats/2", bytes.NewReader(body))
+		r = mux.SetURLVars(r, ps)
+		r = r.WithContext(middleware.WithClaims(r.Context(), &dao.JwtClaims{Id: userID}))
+
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		return w
+	}
+	patch := func(userID int64, data map[string]string, ifMatch string) (*httptest.ResponseRecorder, dao.ChatDetails) {
+		body, _ := json.Marshal(data)
+		w := request(userID, http.MethodPatch, body, ifMatch, ctrl.Update)
+		details := dao.ChatDetails{}
+		json.Unmarshal(w.Body.Bytes(), &details)
+
+		return w, details
+	}
+
+	etag := request(goodId, http.MethodGet, nil, "", ctrl.Get).Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	w, details := patch(goodId, map[string]string{
+		"name":        "renamed",
+		"description": "about\nchat",
+		"avatar":      "https://example.com/avatar.png",
+	}, etag)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "renamed", details.Name)
+	assert.Equal(t, "about\nchat", details.Description)
+	assert.Equal(t, "https://example.com/avatar.png", details.Avatar)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+
+	// stale version
+	w, _ = patch(goodId, map[string]string{"name": "lost update"}, etag)
+	apiErr := dao.ApiError{}
+	json.Unmarshal(w.Body.Bytes(), &apiErr)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	assert.Equal(t, dao.CodePreconditionFailed, apiErr.Code)
+
+	// write is conditional too, request which read chat before the last update fails
+	chat, _ := ctrl.service.Get(2, nil)
+	settings := ctrl.settingsService.Get(2)
+	_, err := ctrl.settingsService.Update(settings, nil, chat.UpdatedAt.Add(-time.Second))
+	assert.Equal(t, service.ErrVersionConflict, err)
+	_, err = ctrl.settingsService.Update(settings, nil, chat.UpdatedAt)
+	assert.Nil(t, err)
+
+	// missing fields are kept
+	w, details = patch(goodId, map[string]string{"description": ""}, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "renamed", details.Name)
+	assert.Equal(t, "", details.Description)
+	assert.Equal(t, "https://example.com/avatar.png", details.Avatar)
+	assert.Equal(t, w.Header().Get("ETag"), request(goodId, http.MethodGet, nil, "", ctrl.Get).Header().Get("ETag"))
+
+	w, _ = patch(goodId, map[string]string{"name": "", "avatar": "not a url"}, "")
+	apiErr = dao.ApiError{}
+	json.Unmarshal(w.Body.Bytes(), &apiErr)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Len(t, apiErr.Fields, 2)
+
+	// plain members can't rename
+	w, _ = patch(2, map[string]string{"name": "by member"}, "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	messages := make([]ewc.Message, 0)
+	db := getDb()
+	db.Where("chat_id = ? AND user_id = ?", 2, dao.SystemUserID).Find(&messages)
+	db.Close()
+
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, "login_0 renamed chat to renamed", messages[0].Text)
+	}
+}
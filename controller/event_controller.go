@@ -0,0 +1,141 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"server/hub"
+	"server/model/dao"
+)
+
+const keepAlivePeriod = 30 * time.Second
+
+// EventCtrl - server-sent events stream, fallback for websocket
+type EventCtrl struct {
+	config *dao.Config
+	hub    *hub.Hub
+}
+
+// NewEventCtrl - create event stream controller
+func NewEventCtrl(cfg *dao.Config) *EventCtrl {
+	ctrl := new(EventCtrl)
+	ctrl.config = cfg
+	ctrl.hub = Hub
+
+	return ctrl
+}
+
+// Stream - push chat events of user as text/event-stream.
+// Missed events are replayed after Last-Event-ID while they are kept by hub,
+// otherwise reset event tells client to reload its state.
+func (ctrl *EventCtrl) Stream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		writeError(w, r, http.StatusNotImplemented, dao.CodeNotImplemented, "streaming is not supported")
+		return
+	}
+
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	lastID := int64(0)
+	lastIDValue := r.Header.Get("Last-Event-ID")
+
+	if lastIDValue == "" {
+		lastIDValue = r.FormValue("last_event_id")
+	}
+	if lastIDValue != "" {
+		id, err := strconv.ParseInt(lastIDValue, 10, 64)
+
+		if err != nil {
+			log.Println("parse last event id error:", err)
+			writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid last event id")
+			return
+		}
+
+		lastID = id
+	}
+
+	// register before replay, so nothing is lost between them
+	client := ctrl.hub.Register(claims.Id, claims.Family)
+	defer ctrl.hub.Unregister(client)
+
+	// stream outlives write timeout of server, response controller is why go.mod needs go 1.20
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		log.Println("clear write deadline of event stream error:", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if lastID != 0 {
+		events, ok := ctrl.hub.Replay(claims.Id, lastID)
+
+		if !ok {
+			// buffered events are newer than reload of client, so none of them is skipped
+			events = []dao.Event{{ID: ctrl.hub.LastID(), Type: dao.EventReset}}
+		}
+		for _, event := range events {
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+			lastID = event.ID
+		}
+		if !ok {
+			lastID = 0
+		}
+	}
+
+	flusher.Flush()
+	ticker := time.NewTicker(keepAlivePeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-client.Events():
+			if !ok {
+				return
+			}
+			if event.ID <= lastID {
+				continue
+			}
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+
+			lastID = event.ID
+			flusher.Flush()
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event dao.Event) error {
+	data, err := json.Marshal(event)
+
+	if err != nil {
+		log.Println("marshal event error:", err)
+		return nil
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+
+	return err
+}
@@ -0,0 +1,27 @@
+package controller
+
+import (
+	"net/http"
+
+	"server/middleware"
+	"server/model/dao"
+)
+
+// KeyCtrl - public keys for verification of tokens by other services
+type KeyCtrl struct {
+	config *dao.Config
+}
+
+// NewKeyCtrl - create key controller
+func NewKeyCtrl(cfg *dao.Config) *KeyCtrl {
+	ctrl := new(KeyCtrl)
+	ctrl.config = cfg
+
+	return ctrl
+}
+
+// JWKS - public keys of keyring in JWK set format
+func (ctrl *KeyCtrl) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, middleware.Keys().JWKS())
+}
@@ -1,21 +1,40 @@
 package controller
 
 import (
-	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"server/core/ewc"
+	"server/hub"
 	"server/model/dao"
+	"server/service"
+	"server/validation"
 
 	"github.com/gorilla/mux"
 )
 
+const (
+	defaultPageLimit        = 20
+	maxPageLimit            = 100
+	defaultMessageRevisions = 10
+)
+
 type MessageCtrl struct {
-	config      *dao.Config
-	service     *ewc.DbMessageService
-	chatService *ewc.DbChatService
+	config          *dao.Config
+	service         *ewc.DbMessageService
+	chatService     *ewc.DbChatService
+	readService     *service.DbReadService
+	settingsService *service.DbChatSettingsService
+	historyService  *service.DbHistoryService
+	revisionService *service.DbRevisionService
+	auth            *chatAuth
+	hub             *hub.Hub
+	limits          validation.Limits
 }
 
 func NewMessageCtrl(cfg *dao.Config) *MessageCtrl {
@@ -23,112 +42,354 @@ func NewMessageCtrl(cfg *dao.Config) *MessageCtrl {
 	ctrl.config = cfg
 	ctrl.service = ewc.NewDbMessageService()
 	ctrl.chatService = ewc.NewDbChatService()
+	ctrl.readService = service.NewDbReadService()
+	ctrl.settingsService = service.NewDbChatSettingsService()
+	ctrl.historyService = service.NewDbHistoryService()
+	ctrl.revisionService = service.NewDbRevisionService()
+	ctrl.auth = newChatAuth()
+	ctrl.hub = Hub
+	ctrl.limits = validation.NewLimits(cfg)
 
 	return ctrl
 }
 
 func (ctrl MessageCtrl) Create(w http.ResponseWriter, r *http.Request) {
 	msg := ewc.Message{}
-	claims := getClaims(r)
+	claims, ok := getClaims(w, r)
 
-	if err := json.NewDecoder(r.Body).Decode(msg); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	if !ok {
 		return
 	}
-	if msg.UserID != claims.Id {
-		w.WriteHeader(http.StatusForbidden)
+
+	if !decodeBody(w, r, ctrl.limits.MaxBodyBytes, &msg) {
+		return
+	}
+	if fields := validation.Check(
+		validation.Rule{Field: "text", Value: msg.Text, Limit: ctrl.limits.MessageText},
+	); len(fields) > 0 {
+		writeFieldErrors(w, r, fields)
 		return
 	}
-	if !ctrl.chatService.IsUserInChat(msg.ChatID, claims.Id) {
-		w.WriteHeader(http.StatusForbidden)
+	if msg.UserID != 0 && msg.UserID != claims.Id {
+		writeError(w, r, http.StatusForbidden, dao.CodeNotAuthor, "message must be written by current user")
 		return
 	}
 
-	_, err := ctrl.service.Create(msg)
+	// author, id and timestamps belong to server
+	msg.UserID = claims.Id
+	msg.ID = 0
+	msg.CreatedAt = time.Time{}
+	msg.UpdatedAt = time.Time{}
+	if _, _, ok := ctrl.auth.authorize(w, r, msg.ChatID, claims.Id, permPost); !ok {
+		return
+	}
+
+	if msg.ExpiredAt.IsZero() {
+		if ttl := ctrl.settingsService.Get(msg.ChatID).MessageTTL; ttl > 0 {
+			msg.ExpiredAt = time.Now().Add(time.Duration(ttl) * time.Second)
+		}
+	}
+
+	item, err := ctrl.service.Create(msg)
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("create message error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
+	// everything before own message is read
+	if _, _, err := ctrl.readService.Advance(item.ChatID, claims.Id, item.ID); err != nil {
+		log.Println("advance read cursor error:", err)
+	}
 
-	/*if err := json.NewEncoder(w).Encode(item); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}*/
-	// todo: to socket
+	ctrl.hub.PublishToChat(dao.Event{
+		Type:   dao.EventMessageCreated,
+		ChatID: item.ChatID,
+		Data:   item,
+	})
+	writeJSON(w, http.StatusCreated, item)
 }
 
+// Delete - author deletes own message, admins delete any
 func (ctrl MessageCtrl) Delete(w http.ResponseWriter, r *http.Request) {
-	msg := ewc.Message{}
-	claims := getClaims(r)
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
 	vars := mux.Vars(r)
 	id, err := strconv.ParseInt(vars["id"], 10, 64)
 
 	if err != nil {
 		log.Println("parse id error:", err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid id")
+		return
+	}
+
+	msg, err := ctrl.revisionService.GetMessage(id)
+
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, dao.CodeMessageNotFound, "message not found")
+		return
+	}
+
+	permission := permDeleteMessages
+
+	// own messages are deleted even by read-only members
+	if msg.UserID == claims.Id {
+		permission = permRead
+	}
+	if _, _, ok := ctrl.auth.authorize(w, r, msg.ChatID, claims.Id, permission); !ok {
 		return
 	}
-	if err := json.NewDecoder(r.Body).Decode(msg); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	if !ctrl.service.Delete(msg) {
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
 		return
 	}
-	if msg.ID != id {
-		w.WriteHeader(http.StatusBadRequest)
+
+	ctrl.hub.PublishToChat(dao.Event{
+		Type:   dao.EventMessageDeleted,
+		ChatID: msg.ChatID,
+		Data:   dao.MessageRef{ID: msg.ID, ChatID: msg.ChatID},
+	})
+}
+
+// Update - edit text of own message
+func (ctrl MessageCtrl) Update(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+
+	if err != nil {
+		log.Println("parse id error:", err)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid id")
+		return
+	}
+
+	edit := dao.MessageEdit{}
+
+	if !decodeBody(w, r, ctrl.limits.MaxBodyBytes, &edit) {
+		return
+	}
+	if fields := validation.Check(
+		validation.Rule{Field: "text", Value: edit.Text, Limit: ctrl.limits.MessageText},
+	); len(fields) > 0 {
+		writeFieldErrors(w, r, fields)
+		return
+	}
+
+	msg, err := ctrl.revisionService.GetMessage(id)
+
+	if err != nil {
+		log.Println("get message for edit error:", err)
+		writeError(w, r, http.StatusNotFound, dao.CodeMessageNotFound, "message not found")
 		return
 	}
 	if msg.UserID != claims.Id {
-		w.WriteHeader(http.StatusForbidden)
+		writeError(w, r, http.StatusForbidden, dao.CodeNotAuthor, "only author can edit message")
 		return
 	}
-	if !ctrl.service.Delete(msg) {
-		w.WriteHeader(http.StatusInternalServerError)
+	if _, _, ok := ctrl.auth.authorize(w, r, msg.ChatID, claims.Id, permPost); !ok {
 		return
 	}
+
+	limit := ctrl.config.MessageRevisions
+
+	if limit <= 0 {
+		limit = defaultMessageRevisions
+	}
+
+	msg, revision, err := ctrl.revisionService.Edit(msg, edit.Text, limit)
+
+	if err != nil {
+		log.Println("edit message error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+
+	data := dao.MessageData{
+		Message:  msg,
+		EditedAt: &revision.EditedAt,
+	}
+
+	ctrl.hub.PublishToChat(dao.Event{
+		Type:   dao.EventMessageEdited,
+		ChatID: msg.ChatID,
+		Data:   data,
+	})
+
+	if hasInclude(getInclude(r.FormValue("include")), "revisions") {
+		data.Revisions = ctrl.revisionService.GetRevisions(id)
+	}
+	writeJSON(w, http.StatusOK, data)
 }
 
+// Get - single message, edit history is given to author only
+func (ctrl MessageCtrl) Get(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+
+	if err != nil {
+		log.Println("parse id error:", err)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid id")
+		return
+	}
+
+	msg, err := ctrl.revisionService.GetMessage(id)
+
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, dao.CodeMessageNotFound, "message not found")
+		return
+	}
+	if _, _, ok := ctrl.auth.authorize(w, r, msg.ChatID, claims.Id, permRead); !ok {
+		return
+	}
+
+	data := dao.MessageData{Message: msg}
+	revisions := ctrl.revisionService.GetRevisions(id)
+
+	if len(revisions) > 0 {
+		data.EditedAt = &revisions[0].EditedAt
+	}
+	if msg.UserID == claims.Id && hasInclude(getInclude(r.FormValue("include")), "revisions") {
+		data.Revisions = revisions
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// GetByChat - messages of chat, newest first.
+// Keyset pagination by before_id/after_id/limit, ?page= is kept for old clients.
 func (ctrl MessageCtrl) GetByChat(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	chatId, err := strconv.ParseInt(vars["chat_id"], 10, 64)
 
 	if err != nil {
 		log.Println("parse id error:", err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid id")
+		return
+	}
+
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	if _, _, ok := ctrl.auth.authorize(w, r, chatId, claims.Id, permRead); !ok {
+		return
+	}
+	if r.FormValue("page") != "" {
+		ctrl.getByPage(w, r, chatId)
 		return
 	}
 
+	beforeId, errBefore := getIntParam(r, "before_id")
+	afterId, errAfter := getIntParam(r, "after_id")
+	limit, errLimit := getIntParam(r, "limit")
+
+	if errBefore != nil || errAfter != nil || errLimit != nil || beforeId < 0 || afterId < 0 || limit < 0 {
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "before_id, after_id and limit must be positive numbers")
+		return
+	}
+	if limit == 0 {
+		limit = int64(ctrl.config.PageLimit)
+	}
+	if limit <= 0 {
+		limit = defaultPageLimit
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+
+	messages, err := ctrl.historyService.GetByCursor(chatId, beforeId, afterId, int(limit))
+
+	if err != nil {
+		log.Println("get messages by cursor error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+
+	setPageLinks(w, r, messages, int(limit))
+
+	writeJSON(w, http.StatusOK, messages)
+}
+
+func (ctrl MessageCtrl) getByPage(w http.ResponseWriter, r *http.Request, chatId int64) {
 	page, err := strconv.Atoi(r.FormValue("page"))
 
 	if err != nil {
 		log.Println("parse page error:", err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "page must be a number")
 		return
 	}
 
-	claims := getClaims(r)
+	messages, err := ctrl.historyService.GetByPage(chatId, page)
 
-	if !ctrl.chatService.IsUserInChat(chatId, claims.Id) {
-		w.WriteHeader(http.StatusForbidden)
+	if err != nil {
+		log.Println("get messages by page error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
 		return
 	}
 
-	messages := ctrl.service.GetByChat(chatId, page)
+	writeJSON(w, http.StatusOK, messages)
+}
 
-	if err := json.NewEncoder(w).Encode(messages); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+// setPageLinks - Link header with next (older) and prev (newer) pages and X-Next-Cursor.
+// Next page is given only when current one is full.
+func setPageLinks(w http.ResponseWriter, r *http.Request, messages []ewc.Message, limit int) {
+	if len(messages) == 0 {
 		return
 	}
+
+	links := make([]string, 0, 2)
+	newest := messages[0].ID
+	oldest := messages[len(messages)-1].ID
+	pageLink := func(param string, id int64, rel string) string {
+		query := url.Values{}
+		query.Set(param, strconv.FormatInt(id, 10))
+		query.Set("limit", strconv.Itoa(limit))
+
+		return fmt.Sprintf(`<%s?%s>; rel="%s"`, r.URL.Path, query.Encode(), rel)
+	}
+
+	if len(messages) == limit {
+		links = append(links, pageLink("before_id", oldest, "next"))
+		w.Header().Set("X-Next-Cursor", strconv.FormatInt(oldest, 10))
+	}
+
+	links = append(links, pageLink("after_id", newest, "prev"))
+	w.Header().Set("Link", strings.Join(links, ", "))
 }
 
 func (ctrl MessageCtrl) GetLastId(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
 	chatId, err := strconv.ParseInt(vars["chat_id"], 10, 64)
 
 	if err != nil {
 		log.Println("parse id error:", err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid id")
+		return
+	}
+	if _, _, ok := ctrl.auth.authorize(w, r, chatId, claims.Id, permRead); !ok {
 		return
 	}
 
@@ -136,3 +397,62 @@ func (ctrl MessageCtrl) GetLastId(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("X-Last-Id", strconv.FormatInt(lastId, 10))
 }
+
+// MarkRead - move read cursor of user in chat and notify other members
+func (ctrl MessageCtrl) MarkRead(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	chatId, err := strconv.ParseInt(vars["chat_id"], 10, 64)
+
+	if err != nil {
+		log.Println("parse id error:", err)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid id")
+		return
+	}
+
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	data := dao.ReadData{}
+
+	if _, _, ok := ctrl.auth.authorize(w, r, chatId, claims.Id, permRead); !ok {
+		return
+	}
+	if !decodeBody(w, r, ctrl.limits.MaxBodyBytes, &data) {
+		return
+	}
+	if data.MessageID <= 0 || data.MessageID > ctrl.service.GetLastId(chatId) {
+		writeFieldErrors(w, r, []dao.FieldError{{
+			Field:   "message_id",
+			Code:    dao.FieldInvalid,
+			Message: "message is not in chat",
+		}})
+		return
+	}
+
+	cursor, moved, err := ctrl.readService.Advance(chatId, claims.Id, data.MessageID)
+
+	if err != nil {
+		log.Println("advance read cursor error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+	if moved {
+		recipients := make([]int64, 0)
+
+		for _, userId := range ctrl.hub.Recipients(chatId) {
+			if userId != claims.Id {
+				recipients = append(recipients, userId)
+			}
+		}
+
+		ctrl.hub.Send(dao.Event{
+			Type:   dao.EventMessagesRead,
+			ChatID: chatId,
+			Data:   cursor,
+		}, recipients)
+	}
+	writeJSON(w, http.StatusOK, cursor)
+}
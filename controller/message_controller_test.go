@@ -6,10 +6,14 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"server/core/ewc"
+	"server/middleware"
+	"server/model/dao"
+	"server/service"
 
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"github.com/joho/godotenv"
@@ -35,6 +39,8 @@ func setupMsg() {
 		DbDriver:         driver,
 		ConnectionString: connectionString,
 	})
+	service.Setup(cfg)
+	middleware.Setup(cfg)
 
 	db := getDb()
 	db.AutoMigrate(&ewc.Message{})
@@ -93,6 +99,48 @@ func TestCreateMessage(t *testing.T) {
 	assert.Equal(t, http.StatusCreated, status)
 }
 
+func TestCreateMessageValidation(t *testing.T) {
+	setupChats()
+	defer os.Remove(connectionString)
+
+	ctrl := NewMessageCtrl(&dao.Config{MaxBodyBytes: 200, MessageTextMaxLength: 10})
+	create := func(body []byte) (int, dao.ApiError) {
+		status, body := createMResponse(http.MethodPost, "http://localhost/messages", nil, body, ctrl.Create)
+		apiErr := dao.ApiError{}
+		json.Unmarshal(body, &apiErr)
+
+		return status, apiErr
+	}
+
+	body, _ := json.Marshal(ewc.Message{UserID: goodId, ChatID: goodId})
+	status, apiErr := create(body)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.Equal(t, []dao.FieldError{{Field: "text", Code: dao.FieldRequired}}, apiErr.Fields)
+
+	body, _ = json.Marshal(ewc.Message{UserID: goodId, ChatID: goodId, Text: "longer than ten"})
+	status, apiErr = create(body)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.Equal(t, dao.FieldTooLong, apiErr.Fields[0].Code)
+
+	status, apiErr = create([]byte(`{"user_id": 1, "chat_id": 1, "text": "msg", "unknown": true}`))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, dao.CodeInvalidJSON, apiErr.Code)
+
+	status, apiErr = create([]byte(`{"user_id": 1, "chat_id": 1, "text": "` + strings.Repeat("a", 200) + `"}`))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Equal(t, dao.CodeBodyTooLarge, apiErr.Code)
+
+	// author, id and timestamps are set by server
+	status, respBody := createMResponse(http.MethodPost, "http://localhost/messages", nil,
+		[]byte(`{"id": 5, "chat_id": 1, "text": "msg", "created_at": "2000-01-01T00:00:00Z"}`), ctrl.Create)
+	msg := ewc.Message{}
+	json.Unmarshal(respBody, &msg)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.NotEqual(t, int64(5), msg.ID)
+	assert.Equal(t, goodId, msg.UserID)
+	assert.True(t, msg.CreatedAt.After(time.Now().Add(-time.Minute)))
+}
+
 func TestDeleteMessage(t *testing.T) {
 	setupChats()
 	defer os.Remove(connectionString)
@@ -112,3 +160,125 @@ func TestDeleteMessage(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, status)
 }
+
+func TestMarkRead(t *testing.T) {
+	setupChats()
+	defer os.Remove(connectionString)
+
+	ctrl := NewMessageCtrl(cfg)
+	ps := map[string]string{
+		"chat_id": "1",
+	}
+	body, _ := json.Marshal(dao.ReadData{MessageID: 5})
+	status, body := createMResponse(http.MethodPut, "http://localhost/chats/1/read", ps, body, ctrl.MarkRead)
+	cursor := dao.ReadCursor{}
+
+	assert.Equal(t, http.StatusOK, status)
+
+	if err := json.Unmarshal(body, &cursor); err != nil {
+		assert.Failf(t, "invalid body: %s", string(body))
+		return
+	}
+
+	assert.Equal(t, int64(5), cursor.MessageID)
+
+	// cursor never goes back
+	body, _ = json.Marshal(dao.ReadData{MessageID: 3})
+	status, body = createMResponse(http.MethodPut, "http://localhost/chats/1/read", ps, body, ctrl.MarkRead)
+	json.Unmarshal(body, &cursor)
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, int64(5), cursor.MessageID)
+
+	// message from the future
+	body, _ = json.Marshal(dao.ReadData{MessageID: 100000})
+	status, _ = createMResponse(http.MethodPut, "http://localhost/chats/1/read", ps, body, ctrl.MarkRead)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+}
+
+func TestGetByChatCursor(t *testing.T) {
+	setupChats()
+	defer os.Remove(connectionString)
+
+	ctrl := NewMessageCtrl(cfg)
+	ps := map[string]string{
+		"chat_id": "1",
+	}
+	getIds := func(addr string) []int64 {
+		status, body := createMResponse(http.MethodGet, addr, ps, nil, ctrl.GetByChat)
+		messages := make([]ewc.Message, 0)
+
+		assert.Equal(t, http.StatusOK, status)
+
+		if err := json.Unmarshal(body, &messages); err != nil {
+			assert.Failf(t, "invalid body: %s", string(body))
+		}
+
+		ids := make([]int64, 0, len(messages))
+
+		for _, msg := range messages {
+			ids = append(ids, msg.ID)
+		}
+
+		return ids
+	}
+
+	assert.Equal(t, []int64{30, 29, 28}, getIds("http://localhost/chats/1/messages?limit=3"))
+	assert.Equal(t, []int64{20, 19}, getIds("http://localhost/chats/1/messages?before_id=21&limit=2"))
+	assert.Equal(t, []int64{27, 26}, getIds("http://localhost/chats/1/messages?after_id=25&limit=2"))
+	assert.Equal(t, []int64{4, 3}, getIds("http://localhost/chats/1/messages?after_id=2&before_id=5"))
+
+	// old clients
+	assert.NotEmpty(t, getIds("http://localhost/chats/1/messages?page=0"))
+
+	// expired messages waiting for reaper are neither counted in pages nor found by id
+	db := getDb()
+	db.Model(&ewc.Message{}).Where("id in (?)", []int64{29, 30}).Update("expired_at", time.Now().Add(-time.Minute))
+	db.Close()
+
+	ids := getIds("http://localhost/chats/1/messages?page=0")
+	assert.Len(t, ids, 20)
+	assert.Equal(t, int64(28), ids[0])
+
+	status, _ := createMResponse(http.MethodGet, "http://localhost/messages/30", map[string]string{"id": "30"}, nil, ctrl.Get)
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestUpdateMessage(t *testing.T) {
+	setupChats()
+	defer os.Remove(connectionString)
+
+	cfg.MessageRevisions = 2
+	defer func() { cfg.MessageRevisions = 0 }()
+
+	ctrl := NewMessageCtrl(cfg)
+	ps := map[string]string{
+		"id": "1",
+	}
+
+	for _, text := range []string{"first", "second", "third"} {
+		body, _ := json.Marshal(dao.MessageEdit{Text: text})
+		status, _ := createMResponse(http.MethodPut, "http://localhost/messages/1", ps, body, ctrl.Update)
+		assert.Equal(t, http.StatusOK, status)
+	}
+
+	status, body := createMResponse(http.MethodGet, "http://localhost/messages/1?include=revisions", ps, nil, ctrl.Get)
+	msg := dao.MessageData{}
+
+	assert.Equal(t, http.StatusOK, status)
+
+	if err := json.Unmarshal(body, &msg); err != nil {
+		assert.Failf(t, "invalid body: %s", string(body))
+		return
+	}
+
+	assert.Equal(t, "third", msg.Text)
+	assert.NotNil(t, msg.EditedAt)
+	assert.Len(t, msg.Revisions, 2)
+	assert.Equal(t, "second", msg.Revisions[0].Text)
+
+	// empty text
+	body, _ = json.Marshal(dao.MessageEdit{})
+	status, _ = createMResponse(http.MethodPut, "http://localhost/messages/1", ps, body, ctrl.Update)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+}
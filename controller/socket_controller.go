@@ -0,0 +1,144 @@
+package controller
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"server/hub"
+	"server/middleware"
+	"server/model/dao"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	authFrameWait = 10 * time.Second
+	writeWait     = 10 * time.Second
+	pongWait      = 60 * time.Second
+	pingPeriod    = pongWait * 9 / 10
+)
+
+type authFrame struct {
+	Token string `json:"token"`
+}
+
+// SocketCtrl - websocket delivery of chat events
+type SocketCtrl struct {
+	config   *dao.Config
+	hub      *hub.Hub
+	upgrader websocket.Upgrader
+}
+
+// NewSocketCtrl - create socket controller
+func NewSocketCtrl(cfg *dao.Config) *SocketCtrl {
+	ctrl := new(SocketCtrl)
+	ctrl.config = cfg
+	ctrl.hub = Hub
+	ctrl.upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		// auth is done by token, not by cookies, so any origin is fine
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+
+	return ctrl
+}
+
+// Connect - upgrade connection and push events of user chats.
+// Token is taken from X-Auth-Token header or from the first frame.
+func (ctrl *SocketCtrl) Connect(w http.ResponseWriter, r *http.Request) {
+	var claims *dao.JwtClaims
+	var err error
+
+	if token := r.Header.Get("X-Auth-Token"); token != "" {
+		if claims, err = middleware.ValidateToken(token); err != nil {
+			writeError(w, r, http.StatusUnauthorized, dao.CodeUnauthorized, "invalid token")
+			return
+		}
+	}
+
+	conn, err := ctrl.upgrader.Upgrade(w, r, nil)
+
+	if err != nil {
+		log.Println("websocket upgrade error:", err)
+		return
+	}
+	if claims == nil {
+		if claims, err = ctrl.readAuthFrame(conn); err != nil {
+			log.Println("websocket auth error:", err)
+			conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "unauthorized"),
+				time.Now().Add(writeWait),
+			)
+			conn.Close()
+			return
+		}
+	}
+
+	client := ctrl.hub.Register(claims.Id, claims.Family)
+
+	go ctrl.writePump(conn, client)
+	ctrl.readPump(conn, client)
+}
+
+func (ctrl *SocketCtrl) readAuthFrame(conn *websocket.Conn) (*dao.JwtClaims, error) {
+	frame := authFrame{}
+	conn.SetReadDeadline(time.Now().Add(authFrameWait))
+
+	if err := conn.ReadJSON(&frame); err != nil {
+		return nil, err
+	}
+
+	return middleware.ValidateToken(frame.Token)
+}
+
+// readPump - only keeps connection alive, clients don't send anything after auth
+func (ctrl *SocketCtrl) readPump(conn *websocket.Conn, client *hub.Client) {
+	defer ctrl.hub.Unregister(client)
+
+	conn.SetReadLimit(512)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			return
+		}
+	}
+}
+
+func (ctrl *SocketCtrl) writePump(conn *websocket.Conn, client *hub.Client) {
+	ticker := time.NewTicker(pingPeriod)
+
+	defer func() {
+		ticker.Stop()
+		conn.Close()
+	}()
+
+	for {
+		select {
+		case event, ok := <-client.Events():
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -1,24 +1,47 @@
 package controller
 
 import (
+	"archive/zip"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 	"time"
 
 	"server/core/ewc"
+	"server/hub"
+	"server/middleware"
 	"server/model/dao"
+	"server/password"
+	"server/service"
+	"server/totp"
+	"server/validation"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
 )
 
+const defaultMfaIssuer = "eisenwort"
+
 // UserCtrl - controller fot user
 type UserCtrl struct {
-	config        *dao.Config
-	service       *ewc.DbUserService
-	tokenLifeTime time.Duration
+	config          *dao.Config
+	service         *ewc.DbUserService
+	chatService     *ewc.DbChatService
+	tokenService    *service.DbTokenService
+	sessionService  *service.DbSessionService
+	duressService   *service.DbDuressService
+	passwordService *service.DbPasswordService
+	mfaService      *service.DbMfaService
+	accountService  *service.DbAccountService
+	hub             *hub.Hub
+	policy          password.Policy
+	limits          validation.Limits
+	tokenLifeTime   time.Duration
+	refreshLifeTime time.Duration
+	mfaLifeTime     time.Duration
+	now             func() time.Time
 }
 
 // NewUserCtrl - create user controller
@@ -26,114 +49,814 @@ func NewUserCtrl(cfg *dao.Config) *UserCtrl {
 	ctrl := new(UserCtrl)
 	ctrl.config = cfg
 	ctrl.service = ewc.NewDbUserService()
+	ctrl.chatService = ewc.NewDbChatService()
+	ctrl.tokenService = service.NewDbTokenService()
+	ctrl.sessionService = service.NewDbSessionService()
+	ctrl.duressService = service.NewDbDuressService()
+	ctrl.passwordService = service.NewDbPasswordService(cfg.BcryptCost)
+	ctrl.policy = password.NewPolicy(cfg.PasswordMinLength)
+	ctrl.limits = validation.NewLimits(cfg)
 	ctrl.tokenLifeTime = 1 * time.Hour
+	ctrl.refreshLifeTime = 336 * time.Hour
+	ctrl.mfaService = service.NewDbMfaService()
+	ctrl.accountService = service.NewDbAccountService()
+	ctrl.hub = Hub
+	ctrl.mfaLifeTime = 5 * time.Minute
+	ctrl.now = time.Now
 
 	return ctrl
 }
 
-// Login - auth user
+// Login - auth user.
+// Login with reset password looks like usual one, but chats of user are hidden or wiped.
 func (ctrl *UserCtrl) Login(w http.ResponseWriter, r *http.Request) {
-	data := make(map[string]string)
-	var login, password string
-	ok := false
+	data := dao.Credentials{}
 
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	if !decodeBody(w, r, ctrl.limits.MaxBodyBytes, &data) {
 		return
 	}
-	if login, ok = data["login"]; !ok {
-		w.WriteHeader(http.StatusUnprocessableEntity)
+
+	// limits of registration are not checked, they may be changed since then
+	fields := validation.Check(
+		validation.Rule{Field: "login", Value: data.Login, Limit: validation.Required},
+		validation.Rule{Field: "password", Value: data.Password, Limit: validation.Required},
+	)
+
+	if len(fields) > 0 {
+		writeFieldErrors(w, r, fields)
 		return
 	}
-	if password, ok = data["password"]; !ok {
-		w.WriteHeader(http.StatusUnprocessableEntity)
+
+	user := ctrl.service.Login(data.Login, data.Password)
+
+	if user == nil {
+		writeError(w, r, http.StatusNotFound, dao.CodeInvalidCredentials, "wrong login or password")
 		return
 	}
 
-	user := ctrl.service.Login(login, password)
+	duress := isDuressPassword(user, data.Password)
 
-	if user == nil {
-		w.WriteHeader(http.StatusNotFound)
+	if ctrl.mfaService.IsEnabled(user.ID) {
+		ctrl.startMfa(w, r, user.ID, data.DeviceName, duress)
 		return
 	}
 
-	jsonData, _ := json.Marshal(ctrl.createAuthData(user.ID))
-	w.Write(jsonData)
+	ctrl.completeLogin(w, r, user.ID, user.Login, data.DeviceName, duress)
 }
 
-// Login - auth user
-func (ctrl *UserCtrl) Registration(w http.ResponseWriter, r *http.Request) {
-	data := make(map[string]string)
-	var login, password, resetPassword string
-	ok := false
+// LoginMfa - second step of login, mfa token is exchanged for tokens with TOTP or recovery code
+func (ctrl *UserCtrl) LoginMfa(w http.ResponseWriter, r *http.Request) {
+	data := dao.MfaLogin{}
+
+	if !decodeBody(w, r, ctrl.limits.MaxBodyBytes, &data) {
+		return
+	}
+
+	claims, err := middleware.ValidateMfaToken(data.MfaToken)
+
+	if err != nil {
+		writeError(w, r, http.StatusUnauthorized, dao.CodeUnauthorized, "invalid mfa token")
+		return
+	}
 
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	challenge, err := ctrl.mfaService.GetChallenge(claims.Jti, ctrl.now())
+
+	if err != nil || challenge.UserID != claims.Id {
+		writeError(w, r, http.StatusUnauthorized, dao.CodeUnauthorized, "login is expired, start again")
+		return
+	}
+
+	// wrong codes lock the login out like wrong passwords, new challenges give no more guesses
+	login := ctrl.service.Get(challenge.UserID).Login
+
+	if wait := middleware.LoginLocked(login); wait > 0 {
+		middleware.TooManyRequests(w, r, wait)
+		return
+	}
+	if !ctrl.checkSecondFactor(challenge.UserID, data.Code, data.RecoveryCode) {
+		middleware.LoginFailed(login)
+
+		if err := ctrl.mfaService.FailChallenge(challenge.ID); err != nil {
+			log.Println("fail mfa challenge error:", err)
+		}
+
+		writeError(w, r, http.StatusUnauthorized, dao.CodeInvalidCode, "wrong code")
 		return
 	}
-	if login, ok = data["login"]; !ok {
-		w.WriteHeader(http.StatusUnprocessableEntity)
+	if !ctrl.mfaService.CompleteChallenge(challenge.ID) {
+		writeError(w, r, http.StatusUnauthorized, dao.CodeUnauthorized, "login is expired, start again")
 		return
 	}
-	if password, ok = data["password"]; !ok {
-		w.WriteHeader(http.StatusUnprocessableEntity)
+
+	ctrl.completeLogin(w, r, challenge.UserID, login, challenge.DeviceName, challenge.Duress)
+}
+
+// startMfa - password is right, client has to send second factor with returned token
+func (ctrl *UserCtrl) startMfa(w http.ResponseWriter, r *http.Request, id int64, deviceName string, duress bool) {
+	jti := service.NewID()
+	err := ctrl.mfaService.CreateChallenge(dao.MfaChallenge{
+		Jti:        jti,
+		UserID:     id,
+		Duress:     duress,
+		DeviceName: deviceName,
+		ExpiresAt:  ctrl.now().Add(ctrl.mfaLifeTime),
+	})
+
+	if err != nil {
+		log.Println("create mfa challenge error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+
+	token, err := ctrl.createToken(dao.JwtClaims{
+		Id:  id,
+		Typ: dao.TokenMfaPending,
+		Jti: jti,
+	}, ctrl.mfaLifeTime)
+
+	if err != nil {
+		log.Println("create mfa token error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, dao.MfaPending{MfaToken: token})
+}
+
+// completeLogin - start session after all factors are checked, failures of login are forgotten
+func (ctrl *UserCtrl) completeLogin(w http.ResponseWriter, r *http.Request, id int64, login string,
+	deviceName string, duress bool) {
+	if duress {
+		if err := ctrl.duressLogin(r, id, deviceName); err != nil {
+			log.Println("duress login error:", err)
+			writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+			return
+		}
+	}
+
+	authData, err := ctrl.startSession(r, id, deviceName, duress)
+
+	if err != nil {
+		log.Println("create auth data error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+	if !duress {
+		authData.DuressEvents = ctrl.duressService.CountNotReviewed(id)
+	}
+
+	middleware.LoginSucceeded(login)
+	writeJSON(w, http.StatusOK, authData)
+}
+
+// checkSecondFactor - TOTP code, each code is accepted once, or unused recovery code
+func (ctrl *UserCtrl) checkSecondFactor(id int64, code string, recoveryCode string) bool {
+	if code != "" {
+		mfa, ok := ctrl.mfaService.Get(id)
+
+		if !ok || mfa.ConfirmedAt == nil {
+			return false
+		}
+
+		step, ok := totp.Validate(mfa.Secret, code, ctrl.now())
+
+		return ok && ctrl.mfaService.UseStep(id, step)
+	}
+	if recoveryCode != "" {
+		return ctrl.mfaService.UseRecoveryCode(id, recoveryCode)
+	}
+
+	return false
+}
+
+// Registration - create user and start session
+func (ctrl *UserCtrl) Registration(w http.ResponseWriter, r *http.Request) {
+	data := dao.Registration{}
+
+	if !decodeBody(w, r, ctrl.limits.MaxBodyBytes, &data) {
 		return
 	}
-	if resetPassword, ok = data["reset_password"]; !ok {
-		w.WriteHeader(http.StatusUnprocessableEntity)
+
+	fields := validation.Check(
+		validation.Rule{Field: "login", Value: data.Login, Limit: ctrl.limits.Login},
+		validation.Rule{Field: "password", Value: data.Password, Limit: validation.Required},
+		validation.Rule{Field: "reset_password", Value: data.ResetPassword, Limit: validation.Required},
+	)
+
+	if data.Password != "" && data.ResetPassword != "" {
+		fields = append(fields, ctrl.checkPasswords(data.Password, data.ResetPassword)...)
+	}
+	if len(fields) > 0 {
+		writeFieldErrors(w, r, fields)
 		return
 	}
 
-	existingUser := ctrl.service.GetByLogin(login)
+	existingUser := ctrl.service.GetByLogin(data.Login)
 
 	if existingUser.ID != 0 {
-		w.WriteHeader(http.StatusConflict)
+		writeError(w, r, http.StatusConflict, dao.CodeLoginTaken, "login is taken")
 		return
 	}
 
-	user, err := ctrl.service.Create(login, password, resetPassword)
+	user, err := ctrl.service.Create(data.Login, data.Password, data.ResetPassword)
 
 	if err != nil {
 		log.Println("create user error:", err)
-		errData, _ := json.Marshal(&dao.ApiError{Error: err.Error()})
-		w.WriteHeader(http.StatusConflict)
-		w.Write(errData)
+		writeError(w, r, http.StatusConflict, dao.CodeLoginTaken, err.Error())
+		return
+	}
+
+	// core hashes with its own cost, configured one is applied by rehash.
+	// Account with other cost is not kept, so registration can be repeated.
+	if err := ctrl.passwordService.Change(user.ID, data.Password, data.ResetPassword); err != nil {
+		log.Println("rehash passwords of new user error:", err)
+
+		if err := ctrl.accountService.Delete(user.ID, false); err != nil {
+			log.Println("delete not rehashed user error:", err)
+		}
+
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+
+	authData, err := ctrl.startSession(r, user.ID, data.DeviceName, false)
+
+	if err != nil {
+		log.Println("create auth data error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
 		return
 	}
 
-	jsonData, _ := json.Marshal(ctrl.createAuthData(user.ID))
-	w.WriteHeader(http.StatusCreated)
-	w.Write(jsonData)
+	writeJSON(w, http.StatusCreated, authData)
 }
 
+// RefreshToken - exchange refresh token for new token pair.
+// Every refresh token can be used once, reuse revokes the whole family.
 func (ctrl *UserCtrl) RefreshToken(w http.ResponseWriter, r *http.Request) {
-	claims := getClaims(r)
 	vars := mux.Vars(r)
 	id, err := strconv.ParseInt(vars["id"], 10, 64)
 
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid id")
+		return
+	}
+
+	data := dao.RefreshData{}
+
+	if !decodeBody(w, r, ctrl.limits.MaxBodyBytes, &data) {
 		return
 	}
-	if claims.Id == 0 {
-		w.WriteHeader(http.StatusForbidden)
+
+	claims, err := middleware.ValidateRefreshToken(data.RefreshToken)
+
+	if err != nil || claims.Jti == "" {
+		writeError(w, r, http.StatusUnauthorized, dao.CodeUnauthorized, "invalid refresh token")
 		return
 	}
 	if claims.Id != id {
-		w.WriteHeader(http.StatusForbidden)
+		writeError(w, r, http.StatusForbidden, dao.CodeForbidden, "refresh token of other user")
+		return
+	}
+	if _, err := ctrl.tokenService.Use(claims.Jti); err != nil {
+		log.Println("use refresh token error:", err)
+
+		if err == service.ErrTokenReused {
+			ctrl.hub.DisconnectFamily(claims.Family)
+		}
+
+		writeError(w, r, http.StatusUnauthorized, dao.CodeUnauthorized, "refresh token is used or revoked")
+		return
+	}
+
+	authData, err := ctrl.createAuthData(id, claims.Family)
+
+	if err != nil {
+		log.Println("create auth data error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, authData)
+}
+
+// Logout - end current session
+func (ctrl *UserCtrl) Logout(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	if claims.Family == "" {
+		return
+	}
+	if err := ctrl.sessionService.Revoke(claims.Family); err != nil {
+		log.Println("revoke session error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+
+	ctrl.hub.DisconnectFamily(claims.Family)
+}
+
+// GetSessions - active sessions of user
+func (ctrl *UserCtrl) GetSessions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid id")
+		return
+	}
+
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	if id != claims.Id {
+		writeError(w, r, http.StatusForbidden, dao.CodeForbidden, "")
+		return
+	}
+
+	sessions := ctrl.sessionService.GetForUser(id)
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].Family == claims.Family
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+// DeleteSession - end session of user on some device
+func (ctrl *UserCtrl) DeleteSession(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid id")
+		return
+	}
+
+	userId, err := strconv.ParseInt(vars["user_id"], 10, 64)
+
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid user_id")
+		return
+	}
+
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	if userId != claims.Id {
+		writeError(w, r, http.StatusForbidden, dao.CodeForbidden, "")
+		return
+	}
+
+	session, ok := ctrl.sessionService.Get(userId, id)
+
+	if !ok {
+		writeError(w, r, http.StatusNotFound, dao.CodeSessionNotFound, "session not found")
+		return
+	}
+	if err := ctrl.sessionService.Revoke(session.Family); err != nil {
+		log.Println("revoke session error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+
+	ctrl.hub.DisconnectFamily(session.Family)
+}
+
+// ChangePassword - set new password or reset password, other sessions are ended
+func (ctrl *UserCtrl) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid id")
+		return
+	}
+
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	if id != claims.Id {
+		writeError(w, r, http.StatusForbidden, dao.CodeForbidden, "")
+		return
+	}
+
+	data := dao.PasswordChange{}
+
+	if !decodeBody(w, r, ctrl.limits.MaxBodyBytes, &data) {
+		return
+	}
+	fields := make([]dao.FieldError, 0)
+
+	if data.CurrentPassword == "" {
+		fields = append(fields, dao.FieldError{Field: "current_password", Code: dao.FieldRequired})
+	}
+	if data.Password == "" && data.ResetPassword == "" {
+		fields = append(fields, dao.FieldError{
+			Field:   "password",
+			Code:    dao.FieldRequired,
+			Message: "password or reset_password is required",
+		})
+	}
+	if len(fields) > 0 {
+		writeFieldErrors(w, r, fields)
+		return
+	}
+
+	user := ctrl.service.Get(id)
+
+	if user.ID == 0 {
+		writeError(w, r, http.StatusNotFound, dao.CodeUserNotFound, "user not found")
+		return
+	}
+	// reset password is not accepted here, so duress session can't change anything
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(data.CurrentPassword)) != nil {
+		writeError(w, r, http.StatusForbidden, dao.CodeWrongPassword, "current password is wrong")
 		return
 	}
+	if fields := ctrl.checkChange(&user, data); len(fields) > 0 {
+		writeFieldErrors(w, r, fields)
+		return
+	}
+	if err := ctrl.passwordService.Change(id, data.Password, data.ResetPassword); err != nil {
+		log.Println("change password error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+	families, err := ctrl.sessionService.RevokeOthers(id, claims.Family)
+	ctrl.disconnect(families)
 
-	jsonData, _ := json.Marshal(ctrl.createAuthData(id))
-	w.Write(jsonData)
+	if err != nil {
+		log.Println("revoke sessions error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+}
+
+// EnrollMfa - generate TOTP secret, it works after confirmation
+func (ctrl *UserCtrl) EnrollMfa(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid id")
+		return
+	}
+
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	if id != claims.Id || ctrl.isDuressSession(claims.Family) {
+		writeError(w, r, http.StatusForbidden, dao.CodeForbidden, "")
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+
+	if err != nil {
+		log.Println("generate totp secret error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+	if err := ctrl.mfaService.Enroll(id, secret); err != nil {
+		if err == service.ErrMfaEnabled {
+			writeError(w, r, http.StatusConflict, dao.CodeMfaEnabled, "mfa is enabled")
+			return
+		}
+
+		log.Println("enroll mfa error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+
+	user := ctrl.service.Get(id)
+	issuer := ctrl.config.MfaIssuer
+
+	if issuer == "" {
+		issuer = defaultMfaIssuer
+	}
+
+	writeJSON(w, http.StatusCreated, dao.MfaEnrollment{
+		Secret: secret,
+		URI:    totp.URI(issuer, user.Login, secret),
+	})
+}
+
+// ConfirmMfa - enable TOTP with first code, recovery codes are returned only here
+func (ctrl *UserCtrl) ConfirmMfa(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid id")
+		return
+	}
+
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	if id != claims.Id || ctrl.isDuressSession(claims.Family) {
+		writeError(w, r, http.StatusForbidden, dao.CodeForbidden, "")
+		return
+	}
+
+	data := dao.MfaCode{}
+
+	if !decodeBody(w, r, ctrl.limits.MaxBodyBytes, &data) {
+		return
+	}
+
+	mfa, ok := ctrl.mfaService.Get(id)
+
+	if !ok {
+		writeError(w, r, http.StatusNotFound, dao.CodeMfaNotFound, "mfa is not enrolled")
+		return
+	}
+	if mfa.ConfirmedAt != nil {
+		writeError(w, r, http.StatusConflict, dao.CodeMfaEnabled, "mfa is enabled")
+		return
+	}
+
+	step, ok := totp.Validate(mfa.Secret, data.Code, ctrl.now())
+
+	if !ok {
+		writeFieldErrors(w, r, []dao.FieldError{{Field: "code", Code: dao.FieldInvalid, Message: "wrong code"}})
+		return
+	}
+
+	codes, err := ctrl.mfaService.Confirm(id, step)
+
+	if err != nil {
+		log.Println("confirm mfa error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+	writeJSON(w, http.StatusOK, dao.RecoveryCodes{RecoveryCodes: codes})
+}
+
+// DisableMfa - turn off TOTP, code or recovery code is required
+func (ctrl *UserCtrl) DisableMfa(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid id")
+		return
+	}
+
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	if id != claims.Id || ctrl.isDuressSession(claims.Family) {
+		writeError(w, r, http.StatusForbidden, dao.CodeForbidden, "")
+		return
+	}
+
+	data := dao.MfaCode{}
+
+	if !decodeBody(w, r, ctrl.limits.MaxBodyBytes, &data) {
+		return
+	}
+	if !ctrl.mfaService.IsEnabled(id) {
+		writeError(w, r, http.StatusNotFound, dao.CodeMfaNotFound, "mfa is not enabled")
+		return
+	}
+
+	// same lockout as login with second factor, access token gives no more guesses
+	login := ctrl.service.Get(id).Login
+
+	if wait := middleware.LoginLocked(login); wait > 0 {
+		middleware.TooManyRequests(w, r, wait)
+		return
+	}
+	if !ctrl.checkSecondFactor(id, data.Code, data.RecoveryCode) {
+		middleware.LoginFailed(login)
+		writeError(w, r, http.StatusForbidden, dao.CodeInvalidCode, "wrong code")
+		return
+	}
+	if err := ctrl.mfaService.Disable(id); err != nil {
+		log.Println("disable mfa error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+}
+
+// Export - data of user as zip of JSON files, ?format=json gives single JSON document
+func (ctrl *UserCtrl) Export(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid id")
+		return
+	}
+
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	// messages of hidden chats must not leave with session of reset password
+	if id != claims.Id || ctrl.isDuressSession(claims.Family) {
+		writeError(w, r, http.StatusForbidden, dao.CodeForbidden, "")
+		return
+	}
+
+	chats, err := ctrl.chatService.GetForUser(id)
+
+	if err != nil {
+		log.Println("get chats for export error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+
+	export := dao.Export{
+		Profile:  ctrl.service.Get(id),
+		Friends:  ctrl.service.GetFriends(id),
+		Chats:    chats,
+		Messages: ctrl.accountService.GetMessages(id),
+		Sessions: ctrl.sessionService.GetForUser(id),
+	}
+	name := fmt.Sprintf("export-%d", id)
+
+	if r.FormValue("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.json"`)
+
+		if err := json.NewEncoder(w).Encode(export); err != nil {
+			log.Println("write export error:", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.zip"`)
+
+	if err := writeExportZip(w, export); err != nil {
+		log.Println("write export error:", err)
+	}
+}
+
+// Delete - delete account, user leaves all chats, messages are deleted or anonymized
+func (ctrl *UserCtrl) Delete(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid id")
+		return
+	}
+
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	if id != claims.Id {
+		writeError(w, r, http.StatusForbidden, dao.CodeForbidden, "")
+		return
+	}
+
+	data := dao.AccountDeletion{}
+
+	if !decodeBody(w, r, ctrl.limits.MaxBodyBytes, &data) {
+		return
+	}
+
+	user := ctrl.service.Get(id)
+
+	if user.ID == 0 {
+		writeError(w, r, http.StatusNotFound, dao.CodeUserNotFound, "user not found")
+		return
+	}
+	// reset password is not accepted, so duress session can't delete account
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(data.Password)) != nil {
+		writeError(w, r, http.StatusForbidden, dao.CodeWrongPassword, "password is wrong")
+		return
+	}
+
+	chats, err := ctrl.chatService.GetForUser(id)
+
+	if err != nil {
+		log.Println("get chats for delete error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+
+	sessions := ctrl.sessionService.GetForUser(id)
+	anonymize := ctrl.config.DeletedMessages == dao.MessagesAnonymize
+
+	// chats, sessions and account are removed at once, nothing happens on failure
+	if err := ctrl.accountService.Delete(id, anonymize); err != nil {
+		log.Println("delete account error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
+
+	for _, chat := range chats {
+		ctrl.hub.PublishToChat(dao.Event{
+			Type:   dao.EventChatExited,
+			ChatID: chat.ID,
+			Data:   dao.ChatMemberRef{ChatID: chat.ID, UserID: id},
+		})
+	}
+	for _, session := range sessions {
+		ctrl.hub.DisconnectFamily(session.Family)
+	}
+
+	ctrl.hub.Disconnect(id)
+}
+
+// GetDuressEvents - logins with reset password, session started by such login sees none
+func (ctrl *UserCtrl) GetDuressEvents(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid id")
+		return
+	}
+
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	if id != claims.Id {
+		writeError(w, r, http.StatusForbidden, dao.CodeForbidden, "")
+		return
+	}
+
+	events := make([]dao.DuressEvent, 0)
+
+	if !ctrl.isDuressSession(claims.Family) {
+		events = ctrl.duressService.GetForUser(id)
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+// ReviewDuressEvents - owner has seen logins with reset password
+func (ctrl *UserCtrl) ReviewDuressEvents(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid id")
+		return
+	}
+
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	if id != claims.Id {
+		writeError(w, r, http.StatusForbidden, dao.CodeForbidden, "")
+		return
+	}
+	if ctrl.isDuressSession(claims.Family) {
+		return
+	}
+	if err := ctrl.duressService.Review(id); err != nil {
+		log.Println("review duress events error:", err)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
+		return
+	}
 }
 
 func (ctrl *UserCtrl) Update(w http.ResponseWriter, r *http.Request) {
 	user := new(ewc.User)
-	claims := getClaims(r)
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
 
-	if err := json.NewDecoder(r.Body).Decode(user); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	if !decodeBody(w, r, ctrl.limits.MaxBodyBytes, user) {
 		return
 	}
 
@@ -141,24 +864,27 @@ func (ctrl *UserCtrl) Update(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.ParseInt(vars["id"], 10, 64)
 
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid id")
 		return
 	}
 	if id != user.ID || id != claims.Id {
-		w.WriteHeader(http.StatusForbidden)
+		writeError(w, r, http.StatusForbidden, dao.CodeForbidden, "")
+		return
+	}
+	if fields := validation.Check(
+		validation.Rule{Field: "login", Value: user.Login, Limit: ctrl.limits.Login},
+	); len(fields) > 0 {
+		writeFieldErrors(w, r, fields)
 		return
 	}
 
 	user = ctrl.service.Update(user)
 
 	if user == nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	if err := json.NewEncoder(w).Encode(user); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
 		return
 	}
+	writeJSON(w, http.StatusOK, user)
 }
 
 func (ctrl *UserCtrl) Get(w http.ResponseWriter, r *http.Request) {
@@ -166,31 +892,37 @@ func (ctrl *UserCtrl) Get(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.ParseInt(vars["id"], 10, 64)
 
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid id")
 		return
 	}
 
-	claims := getClaims(r)
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
 
 	if id != claims.Id {
-		w.WriteHeader(http.StatusForbidden)
+		writeError(w, r, http.StatusForbidden, dao.CodeForbidden, "")
 		return
 	}
 
 	user := ctrl.service.Get(id)
 
 	if user.ID == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-	if err := json.NewEncoder(w).Encode(user); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, r, http.StatusNotFound, dao.CodeUserNotFound, "user not found")
 		return
 	}
+	writeJSON(w, http.StatusOK, user)
 }
 
 func (ctrl *UserCtrl) GetByLogin(w http.ResponseWriter, r *http.Request) {
-	claims := getClaims(r)
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
 	vars := mux.Vars(r)
 	login := vars["login"]
 
@@ -205,16 +937,13 @@ func (ctrl *UserCtrl) GetByLogin(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	if !isFriends {
-		w.WriteHeader(http.StatusForbidden)
+		writeError(w, r, http.StatusForbidden, dao.CodeNotFriend, "user is not a friend")
 		return
 	}
 
 	user := ctrl.service.GetByLogin(login)
 
-	if err := json.NewEncoder(w).Encode(user); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
+	writeJSON(w, http.StatusOK, user)
 }
 
 func (ctrl *UserCtrl) GetFriends(w http.ResponseWriter, r *http.Request) {
@@ -222,23 +951,24 @@ func (ctrl *UserCtrl) GetFriends(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.ParseInt(vars["id"], 10, 64)
 
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid id")
 		return
 	}
 
-	claims := getClaims(r)
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
 
 	if id != claims.Id {
-		w.WriteHeader(http.StatusForbidden)
+		writeError(w, r, http.StatusForbidden, dao.CodeForbidden, "")
 		return
 	}
 
 	friends := ctrl.service.GetFriends(claims.Id)
 
-	if err := json.NewEncoder(w).Encode(friends); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
+	writeJSON(w, http.StatusOK, friends)
 }
 
 func (ctrl *UserCtrl) AddFriend(w http.ResponseWriter, r *http.Request) {
@@ -246,30 +976,36 @@ func (ctrl *UserCtrl) AddFriend(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.ParseInt(vars["id"], 10, 64)
 
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid id")
 		return
 	}
 
-	claims := getClaims(r)
-	data := make(map[string]string)
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
+
+	data := dao.FriendRequest{}
 
 	if id != claims.Id {
-		w.WriteHeader(http.StatusForbidden)
+		writeError(w, r, http.StatusForbidden, dao.CodeForbidden, "")
 		return
 	}
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	if !decodeBody(w, r, ctrl.limits.MaxBodyBytes, &data) {
 		return
 	}
-	if _, ok := data["login"]; !ok {
-		w.WriteHeader(http.StatusUnprocessableEntity)
+	if fields := validation.Check(
+		validation.Rule{Field: "login", Value: data.Login, Limit: validation.Required},
+	); len(fields) > 0 {
+		writeFieldErrors(w, r, fields)
 		return
 	}
 
-	user := ctrl.service.GetByLogin(data["login"])
+	user := ctrl.service.GetByLogin(data.Login)
 
 	if user.ID == 0 {
-		w.WriteHeader(http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, dao.CodeUserNotFound, "user not found")
 		return
 	}
 
@@ -277,18 +1013,14 @@ func (ctrl *UserCtrl) AddFriend(w http.ResponseWriter, r *http.Request) {
 
 	for _, item := range friends {
 		if item.ID == user.ID {
-			w.WriteHeader(http.StatusConflict)
+			writeError(w, r, http.StatusConflict, dao.CodeAlreadyFriends, "user is a friend already")
 			return
 		}
 	}
 
 	friend := ctrl.service.AddFriend(claims.Id, user.ID)
-	w.WriteHeader(http.StatusCreated)
 
-	if err := json.NewEncoder(w).Encode(friend); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
+	writeJSON(w, http.StatusCreated, friend)
 }
 
 func (ctrl *UserCtrl) DeleteFriend(w http.ResponseWriter, r *http.Request) {
@@ -296,21 +1028,25 @@ func (ctrl *UserCtrl) DeleteFriend(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.ParseInt(vars["id"], 10, 64)
 
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid id")
 		return
 	}
 
 	userId, err := strconv.ParseInt(vars["user_id"], 10, 64)
 
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, dao.CodeBadRequest, "invalid user_id")
 		return
 	}
 
-	claims := getClaims(r)
+	claims, ok := getClaims(w, r)
+
+	if !ok {
+		return
+	}
 
 	if userId != claims.Id {
-		w.WriteHeader(http.StatusForbidden)
+		writeError(w, r, http.StatusForbidden, dao.CodeForbidden, "")
 		return
 	}
 
@@ -324,28 +1060,229 @@ func (ctrl *UserCtrl) DeleteFriend(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	if !isExist {
-		w.WriteHeader(http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, dao.CodeFriendNotFound, "friend not found")
 		return
 	}
 	if !ctrl.service.DeleteFriend(claims.Id, id) {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, dao.CodeInternal, "")
 		return
 	}
 }
 
-func (ctrl *UserCtrl) createToken(id int64, duration time.Duration) string {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, dao.JwtClaims{
-		Exp: time.Now().Add(duration).Unix(),
-		Id:  id,
+func (ctrl *UserCtrl) createToken(claims dao.JwtClaims, duration time.Duration) (string, error) {
+	now := time.Now()
+	claims.Iat = now.Unix()
+	claims.Nbf = now.Unix()
+	claims.Exp = now.Add(duration).Unix()
+
+	return middleware.Keys().Sign(claims)
+}
+
+// checkPasswords - both passwords follow policy and differ
+func (ctrl *UserCtrl) checkPasswords(password string, resetPassword string) []dao.FieldError {
+	fields := ctrl.policyErrors("password", password)
+	fields = append(fields, ctrl.policyErrors("reset_password", resetPassword)...)
+
+	if password == resetPassword {
+		fields = append(fields, samePasswordsError("reset_password"))
+	}
+
+	return fields
+}
+
+// checkChange - new passwords follow policy and differ from kept ones
+func (ctrl *UserCtrl) checkChange(user *ewc.User, data dao.PasswordChange) []dao.FieldError {
+	switch {
+	case data.Password != "" && data.ResetPassword != "":
+		return ctrl.checkPasswords(data.Password, data.ResetPassword)
+	case data.Password != "":
+		fields := ctrl.policyErrors("password", data.Password)
+
+		if bcrypt.CompareHashAndPassword([]byte(user.ResetPassword), []byte(data.Password)) == nil {
+			fields = append(fields, samePasswordsError("password"))
+		}
+		return fields
+	default:
+		fields := ctrl.policyErrors("reset_password", data.ResetPassword)
+
+		if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(data.ResetPassword)) == nil {
+			fields = append(fields, samePasswordsError("reset_password"))
+		}
+		return fields
+	}
+}
+
+// policyErrors - field errors of password broken policy rule
+func (ctrl *UserCtrl) policyErrors(field string, value string) []dao.FieldError {
+	switch err := ctrl.policy.Check(value); err {
+	case nil:
+		return nil
+	case password.ErrTooShort:
+		return []dao.FieldError{{
+			Field:   field,
+			Code:    dao.FieldTooShort,
+			Message: fmt.Sprintf("must have at least %d characters", ctrl.policy.MinLength),
+		}}
+	case password.ErrTooLong:
+		return []dao.FieldError{{
+			Field:   field,
+			Code:    dao.FieldTooLong,
+			Message: fmt.Sprintf("must have at most %d bytes", password.MaxLength),
+		}}
+	default:
+		return []dao.FieldError{{Field: field, Code: dao.FieldTooWeak, Message: err.Error()}}
+	}
+}
+
+func samePasswordsError(field string) dao.FieldError {
+	return dao.FieldError{Field: field, Code: dao.FieldSame, Message: "password and reset password must differ"}
+}
+
+// writeExportZip - one JSON file per part of export
+func writeExportZip(w http.ResponseWriter, export dao.Export) error {
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{"profile.json", export.Profile},
+		{"friends.json", export.Friends},
+		{"chats.json", export.Chats},
+		{"messages.json", export.Messages},
+		{"sessions.json", export.Sessions},
+	}
+	archive := zip.NewWriter(w)
+
+	for _, file := range files {
+		writer, err := archive.Create(file.name)
+
+		if err != nil {
+			return err
+		}
+
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+
+		if err := encoder.Encode(file.data); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// isDuressPassword - user logged in with reset password, not with real one
+func isDuressPassword(user *ewc.User, password string) bool {
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) == nil {
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(user.ResetPassword), []byte(password)) == nil
+}
+
+// duressLogin - silently hide or wipe chats of user, end other sessions and record event for owner
+func (ctrl *UserCtrl) duressLogin(r *http.Request, id int64, deviceName string) error {
+	action := ctrl.config.DuressAction
+
+	if action != dao.DuressWipe {
+		action = dao.DuressHide
+	}
+
+	chats, err := ctrl.chatService.GetForUser(id)
+
+	if err != nil {
+		return err
+	}
+	// hidden account must not stay owner of chats it leaves
+	if err := ctrl.duressService.HandOverChats(id); err != nil {
+		return err
+	}
+
+	// no events are published, other members shouldn't notice anything either
+	for _, chat := range chats {
+		if action == dao.DuressWipe {
+			ctrl.chatService.Clean(chat)
+		}
+		ctrl.chatService.Exit(chat)
+	}
+	families, err := ctrl.sessionService.RevokeUser(id)
+	ctrl.disconnect(families)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = ctrl.duressService.Record(dao.DuressEvent{
+		UserID:     id,
+		Action:     action,
+		Chats:      len(chats),
+		DeviceName: deviceName,
+		UserAgent:  r.UserAgent(),
+		IP:         middleware.ClientIP(r),
 	})
-	tokenString, _ := token.SignedString([]byte(ctrl.config.JwtSign))
 
-	return tokenString
+	return err
+}
+
+// isDuressSession - session was started by login with reset password
+func (ctrl *UserCtrl) isDuressSession(family string) bool {
+	session, ok := ctrl.sessionService.GetByFamily(family)
+
+	return ok && session.Duress
 }
 
-func (ctrl *UserCtrl) createAuthData(id int64) *dao.AuthData {
+// startSession - record login on device and issue tokens for it
+func (ctrl *UserCtrl) startSession(r *http.Request, id int64, deviceName string, duress bool) (*dao.AuthData, error) {
+	session, err := ctrl.sessionService.Create(dao.Session{
+		UserID:     id,
+		DeviceName: deviceName,
+		UserAgent:  r.UserAgent(),
+		IP:         middleware.ClientIP(r),
+		Duress:     duress,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ctrl.createAuthData(id, session.Family)
+}
+
+// createAuthData - issue access and refresh tokens for session family
+func (ctrl *UserCtrl) createAuthData(id int64, family string) (*dao.AuthData, error) {
+	jti := service.NewID()
+	token, err := ctrl.createToken(dao.JwtClaims{
+		Id:     id,
+		Typ:    dao.TokenAccess,
+		Family: family,
+	}, ctrl.tokenLifeTime)
+
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := ctrl.createToken(dao.JwtClaims{
+		Id:     id,
+		Typ:    dao.TokenRefresh,
+		Jti:    jti,
+		Family: family,
+	}, ctrl.refreshLifeTime)
+
+	if err != nil {
+		return nil, err
+	}
+	if err := ctrl.tokenService.Create(id, family, jti, time.Now().Add(ctrl.refreshLifeTime)); err != nil {
+		return nil, err
+	}
+
 	return &dao.AuthData{
-		Token:        ctrl.createToken(id, ctrl.tokenLifeTime),
-		RefreshToken: ctrl.createToken(id, 336*time.Hour),
+		Token:        token,
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// disconnect - drop open connections of ended sessions
+func (ctrl *UserCtrl) disconnect(families []string) {
+	for _, family := range families {
+		ctrl.hub.DisconnectFamily(family)
 	}
 }
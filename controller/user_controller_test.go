@@ -1,6 +1,7 @@
 package controller
 
 import (
+	"archive/zip"
 	"bytes"
 	"encoding/json"
 	"io/ioutil"
@@ -10,9 +11,14 @@ import (
 	"os"
 	"strconv"
 	"testing"
+	"time"
 
 	"server/core/ewc"
+	"server/middleware"
 	"server/model/dao"
+	"server/ratelimit"
+	"server/service"
+	"server/totp"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
@@ -40,6 +46,8 @@ func setupUser() {
 		DbDriver:         driver,
 		ConnectionString: connectionString,
 	})
+	service.Setup(cfg)
+	middleware.Setup(cfg)
 
 	db := getDb()
 	db.AutoMigrate(&ewc.User{})
@@ -75,10 +83,14 @@ func setupUser() {
 }
 
 func createMResponse(method string, addr string, vars map[string]string, rbody []byte, handler func(w http.ResponseWriter, r *http.Request)) (int, []byte) {
-	token := createJwt()
+	return createUserResponse(goodId, method, addr, vars, rbody, handler)
+}
+
+// createUserResponse - request authenticated as user
+func createUserResponse(userID int64, method string, addr string, vars map[string]string, rbody []byte, handler func(w http.ResponseWriter, r *http.Request)) (int, []byte) {
 	r := httptest.NewRequest(method, addr, bytes.NewReader(rbody))
 	r = mux.SetURLVars(r, vars)
-	r.Header.Add("X-Auth-Token", token)
+	r = r.WithContext(middleware.WithClaims(r.Context(), &dao.JwtClaims{Id: userID}))
 
 	w := httptest.NewRecorder()
 
@@ -137,6 +149,62 @@ func TestRegistration(t *testing.T) {
 	assert.NotEmpty(t, tokenData.RefreshToken)
 }
 
+func TestRegistrationCost(t *testing.T) {
+	setupUser()
+	defer os.Remove(connectionString)
+
+	costCfg := *cfg
+	costCfg.BcryptCost = bcrypt.MinCost + 1
+	ctrl := NewUserCtrl(&costCfg)
+	data, _ := json.Marshal(map[string]string{
+		"login":          "user_999",
+		"password":       "password_999",
+		"reset_password": "password_000",
+	})
+	status, _ := createMResponse(http.MethodPost, "http://localhost/registration", nil, data, ctrl.Registration)
+	assert.Equal(t, http.StatusCreated, status)
+
+	// configured cost applies to new accounts too
+	user := ctrl.service.GetByLogin("user_999")
+
+	for _, hash := range []string{user.Password, user.ResetPassword} {
+		cost, err := bcrypt.Cost([]byte(hash))
+		assert.Nil(t, err)
+		assert.Equal(t, costCfg.BcryptCost, cost)
+	}
+	assert.Nil(t, bcrypt.CompareHashAndPassword([]byte(user.Password), []byte("password_999")))
+
+	// account is not kept with cost of core when rehash fails
+	db := getDb()
+	db.AutoMigrate(&ewc.Message{}, &ewc.Chat{}, &ewc.ChatUser{})
+	db.Exec("CREATE TRIGGER no_rehash BEFORE UPDATE ON users BEGIN SELECT RAISE(ABORT, 'no rehash'); END")
+	db.Close()
+
+	data, _ = json.Marshal(map[string]string{
+		"login":          "user_998",
+		"password":       "password_998",
+		"reset_password": "password_000",
+	})
+	status, _ = createMResponse(http.MethodPost, "http://localhost/registration", nil, data, ctrl.Registration)
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.Zero(t, ctrl.service.GetByLogin("user_998").ID)
+}
+
+func login(t *testing.T, ctrl *UserCtrl) dao.AuthData {
+	data, _ := json.Marshal(map[string]string{
+		"login":    "user_0",
+		"password": "password_0",
+	})
+	_, body := createMResponse(http.MethodPost, "http://localhost/login", nil, data, ctrl.Login)
+	tokenData := dao.AuthData{}
+
+	if err := json.Unmarshal(body, &tokenData); err != nil {
+		assert.Failf(t, "invalid body: %s", string(body))
+	}
+
+	return tokenData
+}
+
 func TestRefreshToken(t *testing.T) {
 	setupUser()
 	defer os.Remove(connectionString)
@@ -145,7 +213,9 @@ func TestRefreshToken(t *testing.T) {
 	ps := map[string]string{
 		"id": "1",
 	}
-	status, body := createMResponse(http.MethodPost, "http://localhost", ps, nil, ctrl.RefreshToken)
+	first := login(t, ctrl)
+	data, _ := json.Marshal(dao.RefreshData{RefreshToken: first.RefreshToken})
+	status, body := createMResponse(http.MethodPost, "http://localhost/users/1/refresh", ps, data, ctrl.RefreshToken)
 	tokenData := dao.AuthData{}
 
 	assert.Equal(t, http.StatusOK, status)
@@ -157,6 +227,21 @@ func TestRefreshToken(t *testing.T) {
 
 	assert.NotEmpty(t, tokenData.Token)
 	assert.NotEmpty(t, tokenData.RefreshToken)
+	assert.NotEqual(t, first.RefreshToken, tokenData.RefreshToken)
+
+	// access token can't be used for refresh
+	data, _ = json.Marshal(dao.RefreshData{RefreshToken: tokenData.Token})
+	status, _ = createMResponse(http.MethodPost, "http://localhost/users/1/refresh", ps, data, ctrl.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// reuse of rotated token revokes the family
+	data, _ = json.Marshal(dao.RefreshData{RefreshToken: first.RefreshToken})
+	status, _ = createMResponse(http.MethodPost, "http://localhost/users/1/refresh", ps, data, ctrl.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	data, _ = json.Marshal(dao.RefreshData{RefreshToken: tokenData.RefreshToken})
+	status, _ = createMResponse(http.MethodPost, "http://localhost/users/1/refresh", ps, data, ctrl.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
 }
 
 func TestUpdate(t *testing.T) {
@@ -286,3 +371,530 @@ func TestDeleteFriend(t *testing.T) {
 	status, _ := createMResponse(http.MethodPost, "http://localhost/users/friends/9", ps, nil, ctrl.DeleteFriend)
 	assert.Equal(t, http.StatusOK, status)
 }
+
+func TestMissingClaims(t *testing.T) {
+	ctrl := NewChatCtrl(cfg)
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/chats", nil)
+	w := httptest.NewRecorder()
+
+	// route without auth middleware must not act as system user
+	ctrl.GetList(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestSessions(t *testing.T) {
+	setupUser()
+	defer os.Remove(connectionString)
+
+	ctrl := NewUserCtrl(cfg)
+	first := login(t, ctrl)
+	login(t, ctrl)
+
+	claims, err := middleware.ValidateToken(first.Token)
+	assert.Nil(t, err)
+
+	// open connections of session
+	revoked := ctrl.hub.Register(1, claims.Family)
+	other := ctrl.hub.Register(1, "other")
+	defer ctrl.hub.Unregister(other)
+
+	ps := map[string]string{
+		"id": "1",
+	}
+	status, body := createMResponse(http.MethodGet, "http://localhost/users/1/sessions", ps, nil, ctrl.GetSessions)
+	sessions := make([]dao.Session, 0)
+
+	assert.Equal(t, http.StatusOK, status)
+
+	if err := json.Unmarshal(body, &sessions); err != nil {
+		assert.Failf(t, "invalid body: %s", string(body))
+		return
+	}
+
+	assert.Len(t, sessions, 2)
+
+	ps = map[string]string{
+		"user_id": "1",
+		"id":      "1",
+	}
+	status, _ = createMResponse(http.MethodDelete, "http://localhost/users/1/sessions/1", ps, nil, ctrl.DeleteSession)
+	assert.Equal(t, http.StatusOK, status)
+
+	status, _ = createMResponse(http.MethodDelete, "http://localhost/users/1/sessions/1", ps, nil, ctrl.DeleteSession)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// tokens of revoked session are rejected
+	_, err = middleware.ValidateToken(first.Token)
+	assert.NotNil(t, err)
+
+	// and its connections are closed
+	_, ok := <-revoked.Events()
+	assert.False(t, ok)
+	ctrl.hub.Send(dao.Event{Type: dao.EventChatUpdated}, []int64{1})
+	assert.Len(t, other.Events(), 1)
+}
+
+func TestDuressLogin(t *testing.T) {
+	setupUser()
+	defer os.Remove(connectionString)
+
+	resetHashedPassword, _ := bcrypt.GenerateFromPassword([]byte("duress_0"), bcrypt.DefaultCost)
+	getDb().Model(&ewc.User{}).Where("login = ?", "user_0").Update("reset_password", string(resetHashedPassword))
+
+	db := getDb()
+	db.AutoMigrate(&ewc.Chat{}, &ewc.ChatUser{})
+	db.Save(&ewc.Chat{ID: 1, OwnerID: goodId, Name: "owned"})
+	db.Save(&ewc.ChatUser{ChatID: 1, UserID: goodId})
+	db.Save(&ewc.ChatUser{ChatID: 1, UserID: goodId + 1})
+	db.Save(&ewc.ChatUser{ChatID: 1, UserID: goodId + 2})
+	db.Save(&dao.ChatRole{ChatID: 1, UserID: goodId + 2, Role: dao.RoleAdmin})
+	db.Save(&ewc.Chat{ID: 2, OwnerID: goodId + 1, Name: "group"})
+	db.Save(&ewc.ChatUser{ChatID: 2, UserID: goodId})
+	db.Save(&dao.ChatRole{ChatID: 2, UserID: goodId, Role: dao.RoleAdmin})
+	db.Close()
+
+	ctrl := NewUserCtrl(cfg)
+	first := login(t, ctrl)
+	assert.Zero(t, first.DuressEvents)
+
+	data, _ := json.Marshal(map[string]string{
+		"login":    "user_0",
+		"password": "duress_0",
+	})
+	status, body := createMResponse(http.MethodPost, "http://localhost/login", nil, data, ctrl.Login)
+	duressData := dao.AuthData{}
+
+	assert.Equal(t, http.StatusOK, status)
+
+	if err := json.Unmarshal(body, &duressData); err != nil {
+		assert.Failf(t, "invalid body: %s", string(body))
+		return
+	}
+
+	assert.NotEmpty(t, duressData.Token)
+	assert.Zero(t, duressData.DuressEvents)
+
+	// owned group chat is handed over, roles are dropped
+	roles := service.NewDbRoleService()
+	owned, _ := ctrl.chatService.Get(1, nil)
+	group, _ := ctrl.chatService.Get(2, nil)
+	assert.Equal(t, goodId+2, owned.OwnerID)
+	assert.Equal(t, dao.RoleOwner, roles.Get(owned, goodId+2))
+	assert.Equal(t, dao.RoleMember, roles.Get(group, goodId))
+
+	// other sessions are ended, duress one works
+	_, err := middleware.ValidateToken(first.Token)
+	assert.NotNil(t, err)
+	duressClaims, err := middleware.ValidateToken(duressData.Token)
+	assert.Nil(t, err)
+
+	// and can't export messages of hidden chats
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/users/1/export", nil)
+	r = mux.SetURLVars(r, map[string]string{"id": "1"})
+	r = r.WithContext(middleware.WithClaims(r.Context(), duressClaims))
+	w := httptest.NewRecorder()
+	ctrl.Export(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// owner sees the event after login with real password
+	second := login(t, ctrl)
+	assert.Equal(t, 1, second.DuressEvents)
+
+	ps := map[string]string{
+		"id": "1",
+	}
+	status, body = createMResponse(http.MethodGet, "http://localhost/users/1/duress_events", ps, nil, ctrl.GetDuressEvents)
+	events := make([]dao.DuressEvent, 0)
+
+	assert.Equal(t, http.StatusOK, status)
+
+	if err := json.Unmarshal(body, &events); err != nil {
+		assert.Failf(t, "invalid body: %s", string(body))
+		return
+	}
+
+	assert.Len(t, events, 1)
+	assert.Equal(t, dao.DuressHide, events[0].Action)
+
+	status, _ = createMResponse(http.MethodPut, "http://localhost/users/1/duress_events/review", ps, nil, ctrl.ReviewDuressEvents)
+	assert.Equal(t, http.StatusOK, status)
+
+	third := login(t, ctrl)
+	assert.Zero(t, third.DuressEvents)
+}
+
+func TestChangePassword(t *testing.T) {
+	setupUser()
+	defer os.Remove(connectionString)
+
+	ctrl := NewUserCtrl(cfg)
+	first := login(t, ctrl)
+	ps := map[string]string{
+		"id": "1",
+	}
+	change := func(data dao.PasswordChange) int {
+		body, _ := json.Marshal(data)
+		status, _ := createMResponse(http.MethodPut, "http://localhost/users/1/password", ps, body, ctrl.ChangePassword)
+
+		return status
+	}
+
+	assert.Equal(t, http.StatusForbidden, change(dao.PasswordChange{
+		CurrentPassword: "wrong_password",
+		Password:        "new_password_0",
+	}))
+	assert.Equal(t, http.StatusUnprocessableEntity, change(dao.PasswordChange{
+		CurrentPassword: "password_0",
+		Password:        "password123",
+	}))
+	assert.Equal(t, http.StatusUnprocessableEntity, change(dao.PasswordChange{
+		CurrentPassword: "password_0",
+		Password:        "short",
+	}))
+	assert.Equal(t, http.StatusUnprocessableEntity, change(dao.PasswordChange{
+		CurrentPassword: "password_0",
+		Password:        "new_password_0",
+		ResetPassword:   "new_password_0",
+	}))
+
+	_, err := middleware.ValidateToken(first.Token)
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusOK, change(dao.PasswordChange{
+		CurrentPassword: "password_0",
+		Password:        "new_password_0",
+	}))
+
+	// other sessions are ended
+	_, err = middleware.ValidateToken(first.Token)
+	assert.NotNil(t, err)
+
+	user := ctrl.service.Get(1)
+	assert.NotNil(t, bcrypt.CompareHashAndPassword([]byte(user.Password), []byte("password_0")))
+	assert.Nil(t, bcrypt.CompareHashAndPassword([]byte(user.Password), []byte("new_password_0")))
+
+	// reset password can't be set to the current one
+	assert.Equal(t, http.StatusUnprocessableEntity, change(dao.PasswordChange{
+		CurrentPassword: "new_password_0",
+		ResetPassword:   "new_password_0",
+	}))
+}
+
+func TestRegistrationPolicy(t *testing.T) {
+	setupUser()
+	defer os.Remove(connectionString)
+
+	ctrl := NewUserCtrl(cfg)
+	data, _ := json.Marshal(map[string]string{
+		"login":          "user_999",
+		"password":       "password_999",
+		"reset_password": "password_999",
+	})
+	status, body := createMResponse(http.MethodPost, "http://localhost/registration", nil, data, ctrl.Registration)
+	apiErr := dao.ApiError{}
+	json.Unmarshal(body, &apiErr)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.Equal(t, dao.CodeValidationFailed, apiErr.Code)
+	assert.Equal(t, []dao.FieldError{{
+		Field:   "reset_password",
+		Code:    dao.FieldSame,
+		Message: "password and reset password must differ",
+	}}, apiErr.Fields)
+
+	// every broken field is listed
+	data, _ = json.Marshal(map[string]string{
+		"login":          "user_999",
+		"password":       "qwerty123",
+		"reset_password": "short",
+	})
+	status, body = createMResponse(http.MethodPost, "http://localhost/registration", nil, data, ctrl.Registration)
+	apiErr = dao.ApiError{}
+	json.Unmarshal(body, &apiErr)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.Len(t, apiErr.Fields, 2)
+	assert.Equal(t, dao.FieldTooWeak, apiErr.Fields[0].Code)
+	assert.Equal(t, dao.FieldTooShort, apiErr.Fields[1].Code)
+
+	data, _ = json.Marshal(map[string]string{"login": "user_999"})
+	status, body = createMResponse(http.MethodPost, "http://localhost/registration", nil, data, ctrl.Registration)
+	apiErr = dao.ApiError{}
+	json.Unmarshal(body, &apiErr)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.Equal(t, []dao.FieldError{
+		{Field: "password", Code: dao.FieldRequired},
+		{Field: "reset_password", Code: dao.FieldRequired},
+	}, apiErr.Fields)
+}
+
+func TestMfa(t *testing.T) {
+	setupUser()
+	defer os.Remove(connectionString)
+
+	clock := time.Unix(1600000000, 0)
+	ctrl := NewUserCtrl(cfg)
+	ctrl.now = func() time.Time {
+		return clock
+	}
+	ps := map[string]string{
+		"id": "1",
+	}
+	mfaLogin := func(data dao.MfaLogin) (int, dao.AuthData) {
+		body, _ := json.Marshal(data)
+		status, body := createMResponse(http.MethodPost, "http://localhost/login/mfa", nil, body, ctrl.LoginMfa)
+		authData := dao.AuthData{}
+		json.Unmarshal(body, &authData)
+
+		return status, authData
+	}
+	pending := func() string {
+		data, _ := json.Marshal(map[string]string{
+			"login":    "user_0",
+			"password": "password_0",
+		})
+		_, body := createMResponse(http.MethodPost, "http://localhost/login", nil, data, ctrl.Login)
+		mfaData := dao.MfaPending{}
+		json.Unmarshal(body, &mfaData)
+
+		return mfaData.MfaToken
+	}
+
+	status, body := createMResponse(http.MethodPost, "http://localhost/users/1/mfa", ps, nil, ctrl.EnrollMfa)
+	enrollment := dao.MfaEnrollment{}
+
+	assert.Equal(t, http.StatusCreated, status)
+
+	if err := json.Unmarshal(body, &enrollment); err != nil {
+		assert.Failf(t, "invalid body: %s", string(body))
+		return
+	}
+
+	assert.Contains(t, enrollment.URI, "otpauth://totp/")
+
+	// not confirmed enrollment doesn't change login
+	assert.NotEmpty(t, login(t, ctrl).Token)
+
+	data, _ := json.Marshal(dao.MfaCode{Code: "000000"})
+	status, _ = createMResponse(http.MethodPut, "http://localhost/users/1/mfa", ps, data, ctrl.ConfirmMfa)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+
+	code, _ := totp.Code(enrollment.Secret, totp.Step(clock))
+	data, _ = json.Marshal(dao.MfaCode{Code: code})
+	status, body = createMResponse(http.MethodPut, "http://localhost/users/1/mfa", ps, data, ctrl.ConfirmMfa)
+	recovery := dao.RecoveryCodes{}
+
+	assert.Equal(t, http.StatusOK, status)
+
+	if err := json.Unmarshal(body, &recovery); err != nil {
+		assert.Failf(t, "invalid body: %s", string(body))
+		return
+	}
+
+	assert.Len(t, recovery.RecoveryCodes, 10)
+	assert.Len(t, recovery.RecoveryCodes[0], 23)
+
+	// password gives only mfa token, which isn't accepted as access token
+	mfaToken := pending()
+	assert.NotEmpty(t, mfaToken)
+	assert.Empty(t, login(t, ctrl).Token)
+	_, err := middleware.ValidateToken(mfaToken)
+	assert.NotNil(t, err)
+
+	// code used for confirmation can't be replayed
+	status, _ = mfaLogin(dao.MfaLogin{MfaToken: mfaToken, Code: code})
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	clock = clock.Add(totp.Period * time.Second)
+	code, _ = totp.Code(enrollment.Secret, totp.Step(clock))
+	status, authData := mfaLogin(dao.MfaLogin{MfaToken: mfaToken, Code: code})
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotEmpty(t, authData.Token)
+
+	// mfa token is used once
+	clock = clock.Add(totp.Period * time.Second)
+	code, _ = totp.Code(enrollment.Secret, totp.Step(clock))
+	status, _ = mfaLogin(dao.MfaLogin{MfaToken: mfaToken, Code: code})
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// recovery code works once
+	status, authData = mfaLogin(dao.MfaLogin{MfaToken: pending(), RecoveryCode: recovery.RecoveryCodes[0]})
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotEmpty(t, authData.Token)
+	status, _ = mfaLogin(dao.MfaLogin{MfaToken: pending(), RecoveryCode: recovery.RecoveryCodes[0]})
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// too many wrong codes end the login
+	middleware.SetupRateLimit(cfg, ratelimit.NewMemoryStore(time.Hour))
+	mfaToken = pending()
+
+	for i := 0; i < 5; i++ {
+		status, _ = mfaLogin(dao.MfaLogin{MfaToken: mfaToken, Code: "000000"})
+		assert.Equal(t, http.StatusUnauthorized, status)
+	}
+
+	// and lock the login out, new challenge gives no more guesses
+	status, _ = mfaLogin(dao.MfaLogin{MfaToken: pending(), Code: code})
+	assert.Equal(t, http.StatusTooManyRequests, status)
+
+	middleware.SetupRateLimit(cfg, ratelimit.NewMemoryStore(time.Hour))
+	status, _ = mfaLogin(dao.MfaLogin{MfaToken: mfaToken, Code: code})
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// mfa token expires
+	mfaToken = pending()
+	clock = clock.Add(ctrl.mfaLifeTime)
+	status, _ = mfaLogin(dao.MfaLogin{MfaToken: mfaToken, RecoveryCode: recovery.RecoveryCodes[1]})
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// disabling has the same lockout, access token gives no more guesses
+	middleware.SetupRateLimit(cfg, ratelimit.NewMemoryStore(time.Hour))
+	data, _ = json.Marshal(dao.MfaCode{Code: "000000"})
+
+	for i := 0; i < 5; i++ {
+		status, _ = createMResponse(http.MethodDelete, "http://localhost/users/1/mfa", ps, data, ctrl.DisableMfa)
+		assert.Equal(t, http.StatusForbidden, status)
+	}
+
+	data, _ = json.Marshal(dao.MfaCode{RecoveryCode: recovery.RecoveryCodes[2]})
+	status, _ = createMResponse(http.MethodDelete, "http://localhost/users/1/mfa", ps, data, ctrl.DisableMfa)
+	assert.Equal(t, http.StatusTooManyRequests, status)
+
+	middleware.SetupRateLimit(cfg, ratelimit.NewMemoryStore(time.Hour))
+	status, _ = createMResponse(http.MethodDelete, "http://localhost/users/1/mfa", ps, data, ctrl.DisableMfa)
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotEmpty(t, login(t, ctrl).Token)
+}
+
+func TestExport(t *testing.T) {
+	setupUser()
+	defer os.Remove(connectionString)
+
+	db := getDb()
+	db.AutoMigrate(&ewc.Message{})
+	db.Save(&ewc.Message{UserID: goodId, ChatID: 1, Text: "own"})
+	db.Save(&ewc.Message{UserID: goodId + 1, ChatID: 1, Text: "other"})
+	db.Close()
+
+	ctrl := NewUserCtrl(cfg)
+	ps := map[string]string{
+		"id": "1",
+	}
+	status, body := createMResponse(http.MethodGet, "http://localhost/users/1/export?format=json", ps, nil, ctrl.Export)
+	export := dao.Export{}
+
+	assert.Equal(t, http.StatusOK, status)
+
+	if err := json.Unmarshal(body, &export); err != nil {
+		assert.Failf(t, "invalid body: %s", string(body))
+		return
+	}
+
+	assert.Equal(t, goodId, export.Profile.ID)
+	assert.Len(t, export.Friends, friendCount)
+	assert.Len(t, export.Messages, 1)
+	assert.Equal(t, "own", export.Messages[0].Text)
+
+	status, body = createMResponse(http.MethodGet, "http://localhost/users/1/export", ps, nil, ctrl.Export)
+	assert.Equal(t, http.StatusOK, status)
+
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+
+	if err != nil {
+		assert.Failf(t, "invalid zip", err.Error())
+		return
+	}
+
+	names := make([]string, 0)
+
+	for _, file := range archive.File {
+		names = append(names, file.Name)
+	}
+
+	assert.Equal(t, []string{"profile.json", "friends.json", "chats.json", "messages.json", "sessions.json"}, names)
+
+	status, _ = createMResponse(http.MethodGet, "http://localhost/users/2/export", map[string]string{"id": "2"}, nil, ctrl.Export)
+	assert.Equal(t, http.StatusForbidden, status)
+}
+
+func TestDeleteAccount(t *testing.T) {
+	for _, mode := range []string{dao.MessagesDelete, dao.MessagesAnonymize} {
+		setupUser()
+
+		db := getDb()
+		db.AutoMigrate(&ewc.Message{}, &ewc.Chat{}, &ewc.ChatUser{})
+		db.Save(&ewc.Message{UserID: goodId, ChatID: 1, Text: "own"})
+		db.Save(&ewc.Friend{UserID: goodId + 1, FriendID: goodId})
+		db.Save(&ewc.Chat{ID: 1, OwnerID: goodId + 1, Name: "group"})
+		db.Save(&ewc.ChatUser{ChatID: 1, UserID: goodId})
+		db.Save(&ewc.ChatUser{ChatID: 1, UserID: goodId + 1})
+		// owned chat goes to the oldest admin
+		db.Save(&ewc.Chat{ID: 2, OwnerID: goodId, Name: "owned"})
+		db.Save(&ewc.ChatUser{ChatID: 2, UserID: goodId})
+		db.Save(&ewc.ChatUser{ChatID: 2, UserID: goodId + 2})
+		db.Save(&ewc.ChatUser{ChatID: 2, UserID: goodId + 3})
+		db.Save(&ewc.ChatUser{ChatID: 2, UserID: goodId + 4})
+		db.Save(&dao.ChatRole{ChatID: 2, UserID: goodId + 3, Role: dao.RoleAdmin})
+		db.Save(&dao.ChatRole{ChatID: 2, UserID: goodId + 4, Role: dao.RoleAdmin})
+		db.Close()
+
+		cfg.DeletedMessages = mode
+		ctrl := NewUserCtrl(cfg)
+		first := login(t, ctrl)
+		ps := map[string]string{
+			"id": "1",
+		}
+
+		data, _ := json.Marshal(dao.AccountDeletion{Password: "wrong_password"})
+		status, _ := createMResponse(http.MethodDelete, "http://localhost/users/1", ps, data, ctrl.Delete)
+		assert.Equal(t, http.StatusForbidden, status)
+
+		// failed deletion leaves account as it was
+		db = getDb()
+		db.DropTable(&dao.MfaChallenge{})
+		data, _ = json.Marshal(dao.AccountDeletion{Password: "password_0"})
+		status, _ = createMResponse(http.MethodDelete, "http://localhost/users/1", ps, data, ctrl.Delete)
+		assert.Equal(t, http.StatusInternalServerError, status)
+		assert.NotZero(t, ctrl.service.Get(goodId).ID)
+		assert.True(t, ctrl.chatService.IsUserInChat(1, goodId))
+		owned, _ := ctrl.chatService.Get(2, nil)
+		assert.Equal(t, goodId, owned.OwnerID)
+		_, err := middleware.ValidateToken(first.Token)
+		assert.Nil(t, err)
+		db.AutoMigrate(&dao.MfaChallenge{})
+		db.Close()
+
+		status, _ = createMResponse(http.MethodDelete, "http://localhost/users/1", ps, data, ctrl.Delete)
+		assert.Equal(t, http.StatusOK, status)
+
+		assert.Zero(t, ctrl.service.Get(goodId).ID)
+		assert.Empty(t, ctrl.service.GetFriends(goodId))
+
+		_, err = middleware.ValidateToken(first.Token)
+		assert.NotNil(t, err)
+		assert.False(t, ctrl.chatService.IsUserInChat(1, goodId))
+		assert.True(t, ctrl.chatService.IsUserInChat(1, goodId+1))
+
+		owned, _ = ctrl.chatService.Get(2, nil)
+		assert.Equal(t, goodId+3, owned.OwnerID)
+		assert.Equal(t, dao.RoleOwner, service.NewDbRoleService().Get(owned, goodId+3))
+
+		db = getDb()
+		friends, own, anonymized := 0, 0, 0
+		db.Model(&ewc.Friend{}).Where("friend_id = ?", goodId).Count(&friends)
+		db.Model(&ewc.Message{}).Where("user_id = ?", goodId).Count(&own)
+		db.Model(&ewc.Message{}).Where("user_id = ?", dao.DeletedUserID).Count(&anonymized)
+		db.Close()
+
+		assert.Zero(t, friends)
+		assert.Zero(t, own)
+
+		if mode == dao.MessagesAnonymize {
+			assert.Equal(t, 1, anonymized)
+		} else {
+			assert.Zero(t, anonymized)
+		}
+
+		os.Remove(connectionString)
+	}
+
+	cfg.DeletedMessages = ""
+}
@@ -1,32 +1,100 @@
 package controller
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 
+	"server/hub"
+	"server/middleware"
 	"server/model/dao"
-
-	"github.com/dgrijalva/jwt-go"
+	"server/service"
+	"server/validation"
 )
 
 var Config *dao.Config
 
-func getClaims(r *http.Request) dao.JwtClaims {
-	claims := dao.JwtClaims{}
-	token := r.Header.Get("X-Auth-Token")
+// Hub - realtime delivery of chat events
+var Hub = hub.New(service.NewDbMemberService())
 
-	_, err := jwt.ParseWithClaims(token, &claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(Config.JwtSign), nil
-	})
+// getClaims - authenticated user put to request context by middleware.
+// Route without middleware gets 401 instead of acting as nobody.
+func getClaims(w http.ResponseWriter, r *http.Request) (dao.JwtClaims, bool) {
+	claims, ok := middleware.ClaimsFrom(r.Context())
 
-	if err != nil {
-		log.Println("parse JWT error:", err)
+	if !ok || claims == nil {
+		log.Println("claims are missing, route is not behind auth middleware:", r.URL.Path)
+		writeError(w, r, http.StatusUnauthorized, dao.CodeUnauthorized, "authentication required")
+		return dao.JwtClaims{}, false
 	}
 
-	return claims
+	return *claims, true
 }
 
 func getInclude(include string) []string {
 	return strings.Split(include, ",")
 }
+
+func hasInclude(includes []string, name string) bool {
+	for _, include := range includes {
+		if include == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getIntParam - integer query param, zero if it's absent
+func getIntParam(r *http.Request, name string) (int64, error) {
+	value := r.FormValue(name)
+
+	if value == "" {
+		return 0, nil
+	}
+
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// decodeBody - strict JSON body, writes error and returns false when body is not accepted
+func decodeBody(w http.ResponseWriter, r *http.Request, maxBytes int64, data interface{}) bool {
+	err := validation.Decode(r.Body, maxBytes, data)
+
+	switch err {
+	case nil:
+		return true
+	case validation.ErrBodyTooLarge:
+		writeError(w, r, http.StatusRequestEntityTooLarge, dao.CodeBodyTooLarge,
+			fmt.Sprintf("request body is larger than %d bytes", maxBytes))
+	default:
+		writeError(w, r, http.StatusBadRequest, dao.CodeInvalidJSON, err.Error())
+	}
+
+	return false
+}
+
+// writeError - error envelope with stable code, message may be empty
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string, message string) {
+	middleware.WriteError(w, r, status, dao.ApiError{Code: code, Error: message})
+}
+
+// writeFieldErrors - 422 with every invalid field of request
+func writeFieldErrors(w http.ResponseWriter, r *http.Request, fields []dao.FieldError) {
+	middleware.WriteError(w, r, http.StatusUnprocessableEntity, dao.ApiError{
+		Code:   dao.CodeValidationFailed,
+		Fields: fields,
+	})
+}
+
+// writeJSON - response body, error of encoding can only be logged after status is sent
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Println("write response error:", err)
+	}
+}
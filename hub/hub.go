@@ -0,0 +1,281 @@
+package hub
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"server/model/dao"
+)
+
+const (
+	clientBuffer = 64
+	historySize  = 1024
+	// event id is start time of hub in milliseconds in high bits and counter in low ones,
+	// so ids keep growing after restart while run sends less than 2^20 events per millisecond
+	// and ids of previous run are below all ids of the current one. Fits int64 till year 2248.
+	epochShift = 20
+)
+
+// MemberLister - ids of chat members, loaded once per event
+type MemberLister interface {
+	MemberIDs(chatID int64) ([]int64, error)
+}
+
+// Client - single connection of user, family is token family of its session
+type Client struct {
+	UserID int64
+	Family string
+	send   chan dao.Event
+	once   sync.Once
+}
+
+// Events - channel with events for client, closed on unregister
+func (c *Client) Events() <-chan dao.Event {
+	return c.send
+}
+
+func (c *Client) close() {
+	c.once.Do(func() {
+		close(c.send)
+	})
+}
+
+// record - delivered event kept for replay.
+// Events without explicit users belong to every member of the chat.
+type record struct {
+	event dao.Event
+	users []int64
+}
+
+// Hub - keeps connections of users and delivers chat events to them
+type Hub struct {
+	mu      sync.RWMutex
+	clients map[int64]map[*Client]struct{}
+	members MemberLister
+	lastID  int64
+	history []record
+}
+
+// New - create hub
+func New(members MemberLister) *Hub {
+	h := new(Hub)
+	h.clients = make(map[int64]map[*Client]struct{})
+	h.members = members
+	h.lastID = time.Now().UnixMilli() << epochShift
+	h.history = make([]record, 0, historySize)
+
+	return h
+}
+
+// Register - add connection for session of user
+func (h *Hub) Register(userID int64, family string) *Client {
+	client := &Client{
+		UserID: userID,
+		Family: family,
+		send:   make(chan dao.Event, clientBuffer),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.clients[userID]; !ok {
+		h.clients[userID] = make(map[*Client]struct{})
+	}
+	h.clients[userID][client] = struct{}{}
+
+	return client
+}
+
+// Unregister - remove connection and close its channel
+func (h *Hub) Unregister(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.remove(client)
+}
+
+// Close - drop all connections, streams of clients end
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, conns := range h.clients {
+		for client := range conns {
+			h.remove(client)
+		}
+	}
+}
+
+// Disconnect - drop all connections of user
+func (h *Hub) Disconnect(userID int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for client := range h.clients[userID] {
+		h.remove(client)
+	}
+}
+
+// DisconnectFamily - drop connections of ended session
+func (h *Hub) DisconnectFamily(family string) {
+	if family == "" {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, conns := range h.clients {
+		for client := range conns {
+			if client.Family == family {
+				h.remove(client)
+			}
+		}
+	}
+}
+
+func (h *Hub) remove(client *Client) {
+	if conns, ok := h.clients[client.UserID]; ok {
+		delete(conns, client)
+
+		if len(conns) == 0 {
+			delete(h.clients, client.UserID)
+		}
+	}
+
+	client.close()
+}
+
+// Recipients - connected users who are members of chat
+func (h *Hub) Recipients(chatID int64) []int64 {
+	memberIDs := h.memberIDs(chatID)
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	recipients := make([]int64, 0, len(memberIDs))
+
+	for _, userID := range memberIDs {
+		if _, ok := h.clients[userID]; ok {
+			recipients = append(recipients, userID)
+		}
+	}
+
+	return recipients
+}
+
+// memberIDs - members of chat, none when they can't be loaded
+func (h *Hub) memberIDs(chatID int64) []int64 {
+	memberIDs, err := h.members.MemberIDs(chatID)
+
+	if err != nil {
+		log.Println("load members of chat error:", err)
+		return nil
+	}
+
+	return memberIDs
+}
+
+// PublishToChat - send event to every connected member of event chat
+func (h *Hub) PublishToChat(event dao.Event) dao.Event {
+	recipients := h.Recipients(event.ChatID)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.deliver(event, nil, recipients)
+}
+
+// Send - send event to all connections of given users
+func (h *Hub) Send(event dao.Event, userIDs []int64) dao.Event {
+	if userIDs == nil {
+		userIDs = []int64{}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.deliver(event, userIDs, userIDs)
+}
+
+// LastID - id of the latest event
+func (h *Hub) LastID() int64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.lastID
+}
+
+// Replay - events for user with id greater than afterID. False when some of them
+// can't be replayed: id is from previous run, from future or older than history.
+func (h *Hub) Replay(userID int64, afterID int64) ([]dao.Event, bool) {
+	h.mu.RLock()
+
+	// ids of previous run and ids which left history are below the window
+	if afterID > h.lastID || afterID < h.lastID-int64(len(h.history)) {
+		h.mu.RUnlock()
+		return nil, false
+	}
+
+	candidates := make([]record, 0)
+
+	for _, item := range h.history {
+		if item.event.ID > afterID {
+			candidates = append(candidates, item)
+		}
+	}
+	h.mu.RUnlock()
+
+	events := make([]dao.Event, 0, len(candidates))
+	// members are loaded once for every chat of replayed events
+	chats := make(map[int64][]int64)
+
+	for _, item := range candidates {
+		users := item.users
+
+		if users == nil {
+			memberIDs, ok := chats[item.event.ChatID]
+
+			if !ok {
+				memberIDs = h.memberIDs(item.event.ChatID)
+				chats[item.event.ChatID] = memberIDs
+			}
+
+			users = memberIDs
+		}
+		for _, id := range users {
+			if id == userID {
+				events = append(events, item.event)
+				break
+			}
+		}
+	}
+
+	return events, true
+}
+
+// deliver - number event, remember it and push to connections.
+// Connections which can't keep up are dropped. Must be called under lock.
+func (h *Hub) deliver(event dao.Event, users []int64, recipients []int64) dao.Event {
+	h.lastID++
+	event.ID = h.lastID
+
+	if len(h.history) == historySize {
+		copy(h.history, h.history[1:])
+		h.history = h.history[:historySize-1]
+	}
+	h.history = append(h.history, record{event: event, users: users})
+
+	for _, userID := range recipients {
+		for client := range h.clients[userID] {
+			select {
+			case client.send <- event:
+			default:
+				h.remove(client)
+			}
+		}
+	}
+
+	return event
+}
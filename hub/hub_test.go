@@ -0,0 +1,167 @@
+package hub
+
+import (
+	"testing"
+	"time"
+
+	"server/model/dao"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeMembers map[int64][]int64
+
+func (m fakeMembers) MemberIDs(chatID int64) ([]int64, error) {
+	return m[chatID], nil
+}
+
+func TestPublishToChat(t *testing.T) {
+	h := New(fakeMembers{1: {10, 20}})
+	first := h.Register(10, "")
+	second := h.Register(20, "")
+	secondDevice := h.Register(20, "")
+	stranger := h.Register(30, "")
+
+	h.PublishToChat(dao.Event{Type: dao.EventMessageCreated, ChatID: 1})
+
+	for _, client := range []*Client{first, second, secondDevice} {
+		select {
+		case event := <-client.Events():
+			assert.Equal(t, dao.EventMessageCreated, event.Type)
+		default:
+			assert.Failf(t, "event not delivered", "user %d", client.UserID)
+		}
+	}
+
+	assert.Empty(t, stranger.Events())
+}
+
+func TestUnregister(t *testing.T) {
+	h := New(fakeMembers{1: {10}})
+	client := h.Register(10, "")
+	h.Unregister(client)
+
+	_, ok := <-client.Events()
+	assert.False(t, ok)
+	assert.Empty(t, h.Recipients(1))
+
+	// second unregister must not panic on closed channel
+	h.Unregister(client)
+}
+
+func TestDisconnect(t *testing.T) {
+	h := New(fakeMembers{1: {10, 20}})
+	first := h.Register(10, "")
+	second := h.Register(10, "")
+	other := h.Register(20, "")
+	h.Disconnect(10)
+
+	for _, client := range []*Client{first, second} {
+		_, ok := <-client.Events()
+		assert.False(t, ok)
+	}
+
+	assert.Equal(t, []int64{20}, h.Recipients(1))
+
+	h.PublishToChat(dao.Event{Type: dao.EventMessageCreated, ChatID: 1})
+	assert.Len(t, other.Events(), 1)
+}
+
+func TestDisconnectFamily(t *testing.T) {
+	h := New(fakeMembers{1: {10}})
+	revoked := h.Register(10, "revoked")
+	other := h.Register(10, "other")
+	h.DisconnectFamily("revoked")
+
+	_, ok := <-revoked.Events()
+	assert.False(t, ok)
+
+	// connections without session are kept
+	h.DisconnectFamily("")
+
+	h.PublishToChat(dao.Event{Type: dao.EventMessageCreated, ChatID: 1})
+	assert.Len(t, other.Events(), 1)
+}
+
+func TestSlowClientDropped(t *testing.T) {
+	h := New(fakeMembers{1: {10}})
+	client := h.Register(10, "")
+
+	for i := 0; i <= clientBuffer; i++ {
+		h.PublishToChat(dao.Event{Type: dao.EventMessageCreated, ChatID: 1})
+	}
+
+	assert.Empty(t, h.Recipients(1))
+	assert.Len(t, client.Events(), clientBuffer)
+}
+
+func TestReplay(t *testing.T) {
+	h := New(fakeMembers{1: {10, 20}, 2: {20}})
+	start := h.LastID()
+
+	first := h.PublishToChat(dao.Event{Type: dao.EventMessageCreated, ChatID: 1})
+	second := h.PublishToChat(dao.Event{Type: dao.EventMessageCreated, ChatID: 2})
+	third := h.Send(dao.Event{Type: dao.EventChatExited, ChatID: 2}, []int64{10})
+
+	assert.True(t, first.ID < second.ID)
+	assert.True(t, second.ID < third.ID)
+
+	events, ok := h.Replay(10, start)
+	assert.True(t, ok)
+	assert.Len(t, events, 2)
+	assert.Equal(t, first.ID, events[0].ID)
+	assert.Equal(t, third.ID, events[1].ID)
+
+	events, ok = h.Replay(20, first.ID)
+	assert.True(t, ok)
+	assert.Len(t, events, 1)
+	assert.Equal(t, second.ID, events[0].ID)
+
+	events, ok = h.Replay(30, start)
+	assert.True(t, ok)
+	assert.Empty(t, events)
+
+	events, ok = h.Replay(10, third.ID)
+	assert.True(t, ok)
+	assert.Empty(t, events)
+}
+
+func TestReplayGap(t *testing.T) {
+	h := New(fakeMembers{1: {10}})
+	start := h.LastID()
+
+	for i := 0; i < historySize+10; i++ {
+		h.PublishToChat(dao.Event{Type: dao.EventMessageCreated, ChatID: 1})
+	}
+
+	events, ok := h.Replay(10, start+10)
+	assert.True(t, ok)
+	assert.Len(t, events, historySize)
+	assert.Equal(t, start+11, events[0].ID)
+
+	// events older than history are lost
+	_, ok = h.Replay(10, start+9)
+	assert.False(t, ok)
+
+	// id from future or from previous run of server
+	_, ok = h.Replay(10, h.LastID()+1)
+	assert.False(t, ok)
+	_, ok = h.Replay(10, 5)
+	assert.False(t, ok)
+
+	// ids keep growing after restart, ids of previous run are not replayed
+	time.Sleep(time.Millisecond)
+	restarted := New(fakeMembers{1: {10}})
+	assert.True(t, restarted.LastID() > h.LastID())
+	_, ok = restarted.Replay(10, h.LastID())
+	assert.False(t, ok)
+}
+
+func TestClose(t *testing.T) {
+	h := New(fakeMembers{1: {10}})
+	client := h.Register(10, "")
+	h.Close()
+
+	_, ok := <-client.Events()
+	assert.False(t, ok)
+}
@@ -0,0 +1,256 @@
+package keyring
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+
+	"server/model/dao"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// legacyKeyID - key of tokens issued before key ids, it's Config.JwtSign
+const legacyKeyID = ""
+
+type key struct {
+	id         string
+	method     jwt.SigningMethod
+	signKey    interface{}
+	verifyKey  interface{}
+	asymmetric bool
+}
+
+// Keyring - signs tokens with current key and verifies them with current and previous keys
+type Keyring struct {
+	current *key
+	keys    map[string]*key
+	order   []*key
+}
+
+// New - load keys from config
+func New(cfg *dao.Config) (*Keyring, error) {
+	ring := new(Keyring)
+	ring.keys = make(map[string]*key)
+	accepted := cfg.JwtKeys
+
+	if cfg.JwtPreviousKeys > 0 && len(accepted) > cfg.JwtPreviousKeys+1 {
+		log.Println("JWT keys ignored:", len(accepted)-cfg.JwtPreviousKeys-1)
+		accepted = accepted[:cfg.JwtPreviousKeys+1]
+	}
+	for i, item := range accepted {
+		if item.ID == legacyKeyID {
+			return nil, fmt.Errorf("JWT key #%d has no id", i)
+		}
+		if _, ok := ring.keys[item.ID]; ok {
+			return nil, fmt.Errorf("JWT key %q is duplicated", item.ID)
+		}
+
+		k, err := loadKey(item)
+
+		if err != nil {
+			return nil, fmt.Errorf("load JWT key %q error: %s", item.ID, err)
+		}
+		if i == 0 && k.signKey == nil {
+			return nil, fmt.Errorf("JWT key %q can't sign, private key is required", item.ID)
+		}
+
+		ring.add(k)
+	}
+	if cfg.JwtSign != "" {
+		ring.add(&key{
+			id:        legacyKeyID,
+			method:    jwt.SigningMethodHS256,
+			signKey:   []byte(cfg.JwtSign),
+			verifyKey: []byte(cfg.JwtSign),
+		})
+	}
+	if len(ring.order) == 0 {
+		return nil, errors.New("no JWT keys")
+	}
+
+	ring.current = ring.order[0]
+
+	return ring, nil
+}
+
+func (ring *Keyring) add(k *key) {
+	ring.keys[k.id] = k
+	ring.order = append(ring.order, k)
+}
+
+// Sign - sign claims with current key, key id is put to kid header
+func (ring *Keyring) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ring.current.method, claims)
+
+	if ring.current.id != legacyKeyID {
+		token.Header["kid"] = ring.current.id
+	}
+
+	return token.SignedString(ring.current.signKey)
+}
+
+// Keyfunc - for jwt.Parse, key is chosen by kid and must match algorithm of token
+func (ring *Keyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	k, ok := ring.keys[kid]
+
+	if !ok {
+		return nil, fmt.Errorf("unknown JWT key %q", kid)
+	}
+	if token.Method.Alg() != k.method.Alg() {
+		return nil, fmt.Errorf("JWT key %q is not for %s", kid, token.Method.Alg())
+	}
+
+	return k.verifyKey, nil
+}
+
+// JWKS - public keys for verification by other services, secrets are never included
+func (ring *Keyring) JWKS() dao.JSONWebKeySet {
+	set := dao.JSONWebKeySet{Keys: make([]dao.JSONWebKey, 0, len(ring.order))}
+
+	for _, k := range ring.order {
+		if !k.asymmetric {
+			continue
+		}
+
+		jwk := dao.JSONWebKey{
+			Kid: k.id,
+			Alg: k.method.Alg(),
+			Use: "sig",
+		}
+
+		switch publicKey := k.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+		}
+
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	return set
+}
+
+func loadKey(item dao.JwtKey) (*key, error) {
+	k := &key{id: item.ID}
+
+	switch item.Algorithm {
+	case jwt.SigningMethodHS256.Alg():
+		if item.Secret == "" {
+			return nil, errors.New("secret is empty")
+		}
+
+		k.method = jwt.SigningMethodHS256
+		k.signKey = []byte(item.Secret)
+		k.verifyKey = []byte(item.Secret)
+
+		return k, nil
+	case jwt.SigningMethodRS256.Alg():
+		k.method = jwt.SigningMethodRS256
+	case SigningMethodEdDSA.Alg():
+		k.method = SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", item.Algorithm)
+	}
+
+	k.asymmetric = true
+
+	if item.PrivateKeyFile != "" {
+		privateKey, err := readPrivateKey(item.PrivateKeyFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		signer, ok := privateKey.(crypto.Signer)
+
+		if !ok {
+			return nil, errors.New("private key can't sign")
+		}
+
+		k.signKey = privateKey
+		k.verifyKey = signer.Public()
+	} else if item.PublicKeyFile != "" {
+		publicKey, err := readPublicKey(item.PublicKeyFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		k.verifyKey = publicKey
+	} else {
+		return nil, errors.New("key file is not set")
+	}
+
+	// PEM type must match algorithm, otherwise token could be verified by wrong method
+	switch k.verifyKey.(type) {
+	case *rsa.PublicKey:
+		if k.method != jwt.SigningMethodRS256 {
+			return nil, errors.New("RSA key for " + item.Algorithm)
+		}
+	case ed25519.PublicKey:
+		if k.method != SigningMethodEdDSA {
+			return nil, errors.New("Ed25519 key for " + item.Algorithm)
+		}
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+
+	return k, nil
+}
+
+func readBlock(path string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+
+	if block == nil {
+		return nil, errors.New("no PEM data in " + path)
+	}
+
+	return block, nil
+}
+
+func readPrivateKey(path string) (interface{}, error) {
+	block, err := readBlock(path)
+
+	if err != nil {
+		return nil, err
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+func readPublicKey(path string) (interface{}, error) {
+	block, err := readBlock(path)
+
+	if err != nil {
+		return nil, err
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
@@ -0,0 +1,172 @@
+package keyring
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"server/model/dao"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+type testClaims struct {
+	Id int64
+}
+
+func (testClaims) Valid() error {
+	return nil
+}
+
+func writeKey(t *testing.T, dir string, name string, privateKey interface{}) string {
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, name)
+	ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+
+	return path
+}
+
+func parse(ring *Keyring, token string) (testClaims, error) {
+	claims := testClaims{}
+	_, err := jwt.ParseWithClaims(token, &claims, ring.Keyfunc)
+
+	return claims, err
+}
+
+func TestRotation(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "keys")
+	defer os.RemoveAll(dir)
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	rsaKeyFile := writeKey(t, dir, "rsa.pem", rsaKey)
+	edKeyFile := writeKey(t, dir, "ed.pem", edKey)
+
+	oldRing, err := New(&dao.Config{
+		JwtKeys: []dao.JwtKey{
+			{ID: "old", Algorithm: "RS256", PrivateKeyFile: rsaKeyFile},
+		},
+	})
+	assert.Nil(t, err)
+
+	oldToken, err := oldRing.Sign(testClaims{Id: 1})
+	assert.Nil(t, err)
+
+	ring, err := New(&dao.Config{
+		JwtKeys: []dao.JwtKey{
+			{ID: "new", Algorithm: "EdDSA", PrivateKeyFile: edKeyFile},
+			{ID: "old", Algorithm: "RS256", PrivateKeyFile: rsaKeyFile},
+		},
+	})
+	assert.Nil(t, err)
+
+	newToken, err := ring.Sign(testClaims{Id: 2})
+	assert.Nil(t, err)
+
+	token, _ := jwt.Parse(newToken, nil)
+	assert.Equal(t, "new", token.Header["kid"])
+	assert.Equal(t, "EdDSA", token.Header["alg"])
+
+	claims, err := parse(ring, newToken)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), claims.Id)
+
+	claims, err = parse(ring, oldToken)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), claims.Id)
+
+	// old key is removed from config
+	ring, err = New(&dao.Config{
+		JwtKeys: []dao.JwtKey{
+			{ID: "new", Algorithm: "EdDSA", PrivateKeyFile: edKeyFile},
+		},
+	})
+	assert.Nil(t, err)
+
+	_, err = parse(ring, oldToken)
+	assert.NotNil(t, err)
+
+	jwks := ring.JWKS()
+	assert.Len(t, jwks.Keys, 1)
+	assert.Equal(t, "OKP", jwks.Keys[0].Kty)
+	assert.Equal(t, "new", jwks.Keys[0].Kid)
+}
+
+func TestPreviousKeysLimit(t *testing.T) {
+	ring, err := New(&dao.Config{
+		JwtKeys: []dao.JwtKey{
+			{ID: "third", Algorithm: "HS256", Secret: "3"},
+			{ID: "second", Algorithm: "HS256", Secret: "2"},
+			{ID: "first", Algorithm: "HS256", Secret: "1"},
+		},
+		JwtPreviousKeys: 1,
+	})
+	assert.Nil(t, err)
+
+	_, ok := ring.keys["second"]
+	assert.True(t, ok)
+
+	_, ok = ring.keys["first"]
+	assert.False(t, ok)
+
+	// secrets are not published
+	assert.Empty(t, ring.JWKS().Keys)
+}
+
+func TestLegacyToken(t *testing.T) {
+	legacy := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims{Id: 3})
+	legacyToken, _ := legacy.SignedString([]byte("secret"))
+
+	ring, err := New(&dao.Config{JwtSign: "secret"})
+	assert.Nil(t, err)
+
+	claims, err := parse(ring, legacyToken)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), claims.Id)
+
+	// token signed without kid by current key stays compatible
+	token, _ := ring.Sign(testClaims{Id: 4})
+	claims, err = parse(ring, token)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), claims.Id)
+}
+
+func TestAlgorithmMismatch(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "keys")
+	defer os.RemoveAll(dir)
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rsaKeyFile := writeKey(t, dir, "rsa.pem", rsaKey)
+
+	_, err := New(&dao.Config{
+		JwtKeys: []dao.JwtKey{
+			{ID: "bad", Algorithm: "EdDSA", PrivateKeyFile: rsaKeyFile},
+		},
+	})
+	assert.NotNil(t, err)
+
+	ring, _ := New(&dao.Config{
+		JwtKeys: []dao.JwtKey{
+			{ID: "rsa", Algorithm: "RS256", PrivateKeyFile: rsaKeyFile},
+		},
+	})
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims{Id: 5})
+	forged.Header["kid"] = "rsa"
+	publicDer, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	forgedToken, _ := forged.SignedString(publicDer)
+
+	_, err = parse(ring, forgedToken)
+	assert.NotNil(t, err)
+}
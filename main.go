@@ -1,26 +1,42 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"server/certificate"
 	"server/controller"
 	"server/core/ewc"
 	"server/middleware"
 	"server/model/dao"
+	"server/service"
 
 	"github.com/gorilla/mux"
 )
 
-const defaultConfigPath = "./cfg.json"
+const (
+	defaultConfigPath      = "./cfg.json"
+	defaultShutdownTimeout = 15 * time.Second
+)
 
 var config *dao.Config
 
 type mhttpHandler = func(w http.ResponseWriter, r *http.Request)
 
+// worker - background job stopped on shutdown
+type worker interface {
+	Start()
+	Stop()
+}
+
 func init() {
 	pathPtr := flag.String("config", defaultConfigPath, "Path for configuration file")
 	flag.Parse()
@@ -41,24 +57,54 @@ func init() {
 }
 
 func jwtHandler(w http.ResponseWriter, r *http.Request, handler mhttpHandler) {
-	if err := middleware.MuxTokenValidation(w, r); err != nil {
-		w.WriteHeader(http.StatusForbidden)
+	r, err := middleware.MuxTokenValidation(w, r)
+
+	if err != nil {
 		return
 	}
+
 	handler(w, r)
 }
 
+// limitedHandler - authenticated route with rate limit per user
+func limitedHandler(w http.ResponseWriter, r *http.Request, handler mhttpHandler) {
+	jwtHandler(w, r, func(w http.ResponseWriter, r *http.Request) {
+		if middleware.LimitApi(w, r) {
+			handler(w, r)
+		}
+	})
+}
+
+// authHandler - login or registration, throttled by ip and login
+func authHandler(w http.ResponseWriter, r *http.Request, handler mhttpHandler) {
+	middleware.LimitAuth(w, r, handler)
+}
+
 func createRouter() http.Handler {
 	userCtrl := controller.NewUserCtrl(config)
 	chatCtrl := controller.NewChatCtrl(config)
 	messageCtrl := controller.NewMessageCtrl(config)
+	socketCtrl := controller.NewSocketCtrl(config)
+	keyCtrl := controller.NewKeyCtrl(config)
+	eventCtrl := controller.NewEventCtrl(config)
 	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(middleware.NotFound)
+	router.MethodNotAllowedHandler = http.HandlerFunc(middleware.MethodNotAllowed)
 
 	// user
-	router.HandleFunc("/login", userCtrl.Login).Methods(http.MethodPost)
-	router.HandleFunc("registration", userCtrl.Registration).Methods(http.MethodPost)
-	router.HandleFunc("users/:id/refresh", func(w http.ResponseWriter, r *http.Request) {
-		jwtHandler(w, r, userCtrl.RefreshToken)
+	router.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		authHandler(w, r, userCtrl.Login)
+	}).Methods(http.MethodPost)
+	router.HandleFunc("/registration", func(w http.ResponseWriter, r *http.Request) {
+		authHandler(w, r, userCtrl.Registration)
+	}).Methods(http.MethodPost)
+	router.HandleFunc("/login/mfa", func(w http.ResponseWriter, r *http.Request) {
+		authHandler(w, r, userCtrl.LoginMfa)
+	}).Methods(http.MethodPost)
+	// access token may be already expired here, refresh token is checked by handler
+	router.HandleFunc("/users/{id}/refresh", userCtrl.RefreshToken).Methods(http.MethodPost)
+	router.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		jwtHandler(w, r, userCtrl.Logout)
 	}).Methods(http.MethodPost)
 	router.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
 		jwtHandler(w, r, userCtrl.Update)
@@ -66,15 +112,45 @@ func createRouter() http.Handler {
 	router.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
 		jwtHandler(w, r, userCtrl.Get)
 	}).Methods(http.MethodGet)
+	router.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		jwtHandler(w, r, userCtrl.Delete)
+	}).Methods(http.MethodDelete)
+	router.HandleFunc("/users/{id}/export", func(w http.ResponseWriter, r *http.Request) {
+		jwtHandler(w, r, userCtrl.Export)
+	}).Methods(http.MethodGet)
 	router.HandleFunc("/users/{id}/friends", func(w http.ResponseWriter, r *http.Request) {
 		jwtHandler(w, r, userCtrl.GetFriends)
 	}).Methods(http.MethodGet)
 	router.HandleFunc("/users/{id}/friends", func(w http.ResponseWriter, r *http.Request) {
-		jwtHandler(w, r, userCtrl.AddFriend)
+		limitedHandler(w, r, userCtrl.AddFriend)
 	}).Methods(http.MethodPost)
 	router.HandleFunc("/users/{user_id}/friends/{id}", func(w http.ResponseWriter, r *http.Request) {
 		jwtHandler(w, r, userCtrl.DeleteFriend)
 	}).Methods(http.MethodDelete)
+	router.HandleFunc("/users/{id}/sessions", func(w http.ResponseWriter, r *http.Request) {
+		jwtHandler(w, r, userCtrl.GetSessions)
+	}).Methods(http.MethodGet)
+	router.HandleFunc("/users/{user_id}/sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		jwtHandler(w, r, userCtrl.DeleteSession)
+	}).Methods(http.MethodDelete)
+	router.HandleFunc("/users/{id}/password", func(w http.ResponseWriter, r *http.Request) {
+		limitedHandler(w, r, userCtrl.ChangePassword)
+	}).Methods(http.MethodPut)
+	router.HandleFunc("/users/{id}/mfa", func(w http.ResponseWriter, r *http.Request) {
+		jwtHandler(w, r, userCtrl.EnrollMfa)
+	}).Methods(http.MethodPost)
+	router.HandleFunc("/users/{id}/mfa", func(w http.ResponseWriter, r *http.Request) {
+		jwtHandler(w, r, userCtrl.ConfirmMfa)
+	}).Methods(http.MethodPut)
+	router.HandleFunc("/users/{id}/mfa", func(w http.ResponseWriter, r *http.Request) {
+		limitedHandler(w, r, userCtrl.DisableMfa)
+	}).Methods(http.MethodDelete)
+	router.HandleFunc("/users/{id}/duress_events", func(w http.ResponseWriter, r *http.Request) {
+		jwtHandler(w, r, userCtrl.GetDuressEvents)
+	}).Methods(http.MethodGet)
+	router.HandleFunc("/users/{id}/duress_events/review", func(w http.ResponseWriter, r *http.Request) {
+		jwtHandler(w, r, userCtrl.ReviewDuressEvents)
+	}).Methods(http.MethodPut)
 	router.HandleFunc("/users/login/{login}", func(w http.ResponseWriter, r *http.Request) {
 		jwtHandler(w, r, userCtrl.GetByLogin)
 	}).Methods(http.MethodGet)
@@ -87,25 +163,61 @@ func createRouter() http.Handler {
 		jwtHandler(w, r, chatCtrl.Get)
 	}).Methods(http.MethodGet)
 	router.HandleFunc("/chats", func(w http.ResponseWriter, r *http.Request) {
-		jwtHandler(w, r, chatCtrl.Create)
+		limitedHandler(w, r, chatCtrl.Create)
 	}).Methods(http.MethodPost)
+	router.HandleFunc("/chats/{id}", func(w http.ResponseWriter, r *http.Request) {
+		jwtHandler(w, r, chatCtrl.Update)
+	}).Methods(http.MethodPatch)
 	router.HandleFunc("/chats/{id}", func(w http.ResponseWriter, r *http.Request) {
 		jwtHandler(w, r, chatCtrl.Delete)
 	}).Methods(http.MethodDelete)
 	router.HandleFunc("/chats/{id}/exit", func(w http.ResponseWriter, r *http.Request) {
 		jwtHandler(w, r, chatCtrl.Exit)
 	}).Methods(http.MethodDelete)
+	router.HandleFunc("/chats/{id}/members", func(w http.ResponseWriter, r *http.Request) {
+		limitedHandler(w, r, chatCtrl.AddMember)
+	}).Methods(http.MethodPost)
+	router.HandleFunc("/chats/{id}/members/{user_id}", func(w http.ResponseWriter, r *http.Request) {
+		jwtHandler(w, r, chatCtrl.RemoveMember)
+	}).Methods(http.MethodDelete)
+	router.HandleFunc("/chats/{id}/invites", func(w http.ResponseWriter, r *http.Request) {
+		limitedHandler(w, r, chatCtrl.CreateInvite)
+	}).Methods(http.MethodPost)
+	router.HandleFunc("/chats/{id}/invites", func(w http.ResponseWriter, r *http.Request) {
+		jwtHandler(w, r, chatCtrl.GetInvites)
+	}).Methods(http.MethodGet)
+	router.HandleFunc("/chats/{id}/invites/{invite_id}", func(w http.ResponseWriter, r *http.Request) {
+		jwtHandler(w, r, chatCtrl.RevokeInvite)
+	}).Methods(http.MethodDelete)
+	router.HandleFunc("/invites/{token}/accept", func(w http.ResponseWriter, r *http.Request) {
+		limitedHandler(w, r, chatCtrl.AcceptInvite)
+	}).Methods(http.MethodPost)
+	router.HandleFunc("/chats/{id}/members/{user_id}/role", func(w http.ResponseWriter, r *http.Request) {
+		jwtHandler(w, r, chatCtrl.SetRole)
+	}).Methods(http.MethodPut)
+	router.HandleFunc("/chats/{id}/owner", func(w http.ResponseWriter, r *http.Request) {
+		jwtHandler(w, r, chatCtrl.TransferOwnership)
+	}).Methods(http.MethodPut)
 	router.HandleFunc("/chats/{id}/clean", func(w http.ResponseWriter, r *http.Request) {
 		jwtHandler(w, r, chatCtrl.Clean)
 	}).Methods(http.MethodDelete)
 	router.HandleFunc("/chats/{chat_id}", func(w http.ResponseWriter, r *http.Request) {
 		jwtHandler(w, r, messageCtrl.GetLastId)
 	}).Methods(http.MethodHead)
+	router.HandleFunc("/chats/{chat_id}/read", func(w http.ResponseWriter, r *http.Request) {
+		jwtHandler(w, r, messageCtrl.MarkRead)
+	}).Methods(http.MethodPut)
 
 	// message
 	router.HandleFunc("/messages", func(w http.ResponseWriter, r *http.Request) {
-		jwtHandler(w, r, messageCtrl.Create)
+		limitedHandler(w, r, messageCtrl.Create)
 	}).Methods(http.MethodPost)
+	router.HandleFunc("/messages/{id}", func(w http.ResponseWriter, r *http.Request) {
+		jwtHandler(w, r, messageCtrl.Get)
+	}).Methods(http.MethodGet)
+	router.HandleFunc("/messages/{id}", func(w http.ResponseWriter, r *http.Request) {
+		limitedHandler(w, r, messageCtrl.Update)
+	}).Methods(http.MethodPut)
 	router.HandleFunc("/messages/{id}", func(w http.ResponseWriter, r *http.Request) {
 		jwtHandler(w, r, messageCtrl.Delete)
 	}).Methods(http.MethodDelete)
@@ -113,7 +225,60 @@ func createRouter() http.Handler {
 		jwtHandler(w, r, messageCtrl.GetByChat)
 	}).Methods(http.MethodGet)
 
-	return router
+	// keys
+	router.HandleFunc("/.well-known/jwks.json", keyCtrl.JWKS).Methods(http.MethodGet)
+
+	// realtime
+	router.HandleFunc("/ws", socketCtrl.Connect).Methods(http.MethodGet)
+	router.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		jwtHandler(w, r, eventCtrl.Stream)
+	}).Methods(http.MethodGet)
+
+	return middleware.RequestID(router)
+}
+
+// newServer - http server with timeouts from config, zero values are replaced by defaults.
+// Event streams clear write timeout for themselves.
+func newServer(handler http.Handler) *http.Server {
+	seconds := func(value int, def int) time.Duration {
+		if value <= 0 {
+			value = def
+		}
+
+		return time.Duration(value) * time.Second
+	}
+	maxHeaderBytes := config.MaxHeaderBytes
+
+	if maxHeaderBytes <= 0 {
+		maxHeaderBytes = http.DefaultMaxHeaderBytes
+	}
+
+	return &http.Server{
+		Addr:              config.ServiceAddress,
+		Handler:           handler,
+		ReadTimeout:       seconds(config.ReadTimeout, 15),
+		ReadHeaderTimeout: seconds(config.ReadHeaderTimeout, 5),
+		WriteTimeout:      seconds(config.WriteTimeout, 60),
+		IdleTimeout:       seconds(config.IdleTimeout, 120),
+		MaxHeaderBytes:    maxHeaderBytes,
+	}
+}
+
+// shutdownServer - wait for in-flight requests until drain deadline, then drop the rest
+func shutdownServer(server *http.Server) {
+	timeout := time.Duration(config.ShutdownTimeout) * time.Second
+
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("stop server error:", err)
+		server.Close()
+	}
 }
 
 func main() {
@@ -122,13 +287,81 @@ func main() {
 		DbDriver:         config.Driver,
 		ConnectionString: config.ConnectionString,
 	})
-	defer util.CloseApp()
-	middleware.Setup(config)
 
-	router := createRouter()
-	log.Println("Server start on", config.ServiceAddress)
+	if err := service.Setup(config); err != nil {
+		util.CloseApp()
+		panic("setup services error: " + err.Error())
+	}
+
+	if err := middleware.Setup(config); err != nil {
+		service.Close()
+		util.CloseApp()
+		panic("setup JWT keys error: " + err.Error())
+	}
+
+	workers := []worker{
+		service.NewMessageReaper(config),
+	}
+	server := newServer(createRouter())
+	servers := []*http.Server{server}
+	// long-lived event streams are never idle, they are closed explicitly
+	server.RegisterOnShutdown(controller.Hub.Close)
 
-	if err := http.ListenAndServe(config.ServiceAddress, router); err != nil {
-		panic("start server error: " + err.Error())
+	if config.TLSCertFile != "" {
+		reloader, err := certificate.NewReloader(config.TLSCertFile, config.TLSKeyFile)
+
+		if err != nil {
+			service.Close()
+			util.CloseApp()
+			panic("load certificate error: " + err.Error())
+		}
+
+		server.TLSConfig = reloader.Config()
+		workers = append(workers, reloader)
+
+		if config.RedirectAddress != "" {
+			redirect := newServer(certificate.RedirectHandler(config.ServiceAddress))
+			redirect.Addr = config.RedirectAddress
+			servers = append(servers, redirect)
+		}
 	}
+	for _, item := range workers {
+		item.Start()
+	}
+
+	errs := make(chan error, len(servers))
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	for _, item := range servers {
+		go func(item *http.Server) {
+			if item.TLSConfig != nil {
+				log.Println("Server start on", item.Addr, "(https)")
+				errs <- item.ListenAndServeTLS("", "")
+				return
+			}
+
+			log.Println("Server start on", item.Addr)
+			errs <- item.ListenAndServe()
+		}(item)
+	}
+
+	select {
+	case err := <-errs:
+		log.Println("start server error:", err)
+	case sig := <-stop:
+		log.Println("Server stopping on", sig)
+	}
+	for _, item := range servers {
+		shutdownServer(item)
+	}
+
+	// workers use database, so they are stopped before it's closed
+	for i := len(workers) - 1; i >= 0; i-- {
+		workers[i].Stop()
+	}
+
+	service.Close()
+	util.CloseApp()
+	log.Println("Server stopped")
 }
@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"context"
+
+	"server/model/dao"
+)
+
+type contextKey int
+
+const (
+	claimsKey contextKey = iota
+	requestIDKey
+)
+
+// WithClaims - context with authenticated user
+func WithClaims(ctx context.Context, claims *dao.JwtClaims) context.Context {
+	return context.WithValue(ctx, claimsKey, claims)
+}
+
+// ClaimsFrom - authenticated user of request context
+func ClaimsFrom(ctx context.Context) (*dao.JwtClaims, bool) {
+	claims, ok := ctx.Value(claimsKey).(*dao.JwtClaims)
+
+	return claims, ok && claims != nil
+}
+
+// WithRequestID - context with id of request
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestIDFrom - id of request, empty outside of RequestID middleware
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+
+	return id
+}
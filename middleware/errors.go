@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+
+	"server/model/dao"
+	"server/service"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID - id from client is kept only when it's short and safe to log
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestID - give every request an id, it's returned in X-Request-ID and in errors.
+// JSON is the default content type of responses, streams override it.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+
+		if !validRequestID.MatchString(id) {
+			id = service.RandomToken(8)
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		w.Header().Set("Content-Type", "application/json")
+		next.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), id)))
+	})
+}
+
+// WriteError - write error envelope with request id
+func WriteError(w http.ResponseWriter, r *http.Request, status int, apiErr dao.ApiError) {
+	apiErr.RequestID = RequestIDFrom(r.Context())
+
+	if apiErr.Error == "" {
+		apiErr.Error = http.StatusText(status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(apiErr); err != nil {
+		log.Println("write error response error:", err)
+	}
+}
+
+// NotFound - handler for unknown routes
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	WriteError(w, r, http.StatusNotFound, dao.ApiError{Code: dao.CodeNotFound})
+}
+
+// MethodNotAllowed - handler for known routes with other methods
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	WriteError(w, r, http.StatusMethodNotAllowed, dao.ApiError{Code: dao.CodeMethodNotAllowed})
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"server/model/dao"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, r, http.StatusForbidden, dao.ApiError{Code: dao.CodeNotMember})
+	}))
+
+	// id of client is kept
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/chats/1", nil)
+	r.Header.Set("X-Request-ID", "abc-123")
+	handler.ServeHTTP(w, r)
+
+	apiErr := dao.ApiError{}
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&apiErr))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, "abc-123", w.Header().Get("X-Request-ID"))
+	assert.Equal(t, dao.CodeNotMember, apiErr.Code)
+	assert.Equal(t, http.StatusText(http.StatusForbidden), apiErr.Error)
+	assert.Equal(t, "abc-123", apiErr.RequestID)
+
+	// unsafe id is replaced
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "http://localhost/chats/1", nil)
+	r.Header.Set("X-Request-ID", "bad id\n")
+	handler.ServeHTTP(w, r)
+
+	apiErr = dao.ApiError{}
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&apiErr))
+	assert.NotEqual(t, "bad id\n", apiErr.RequestID)
+	assert.Len(t, apiErr.RequestID, 16)
+	assert.Equal(t, apiErr.RequestID, w.Header().Get("X-Request-ID"))
+}
+
+func TestNotFound(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/unknown", nil)
+	RequestID(http.HandlerFunc(NotFound)).ServeHTTP(w, r)
+
+	apiErr := dao.ApiError{}
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&apiErr))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, dao.CodeNotFound, apiErr.Code)
+	assert.NotEmpty(t, apiErr.RequestID)
+}
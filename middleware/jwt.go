@@ -5,63 +5,106 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"time"
 
+	"server/keyring"
 	"server/model/dao"
+	"server/ratelimit"
+	"server/service"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/julienschmidt/httprouter"
 )
 
 var config *dao.Config
+var keys *keyring.Keyring
+var sessions = service.NewDbSessionService()
 
 const authHeader = "X-Auth-Token"
 
-func Setup(cfg *dao.Config) {
+// Setup - keep config and load JWT keys from it
+func Setup(cfg *dao.Config) error {
+	ring, err := keyring.New(cfg)
+
+	if err != nil {
+		return err
+	}
+
 	config = cfg
+	keys = ring
+	SetupRateLimit(cfg, ratelimit.NewMemoryStore(storeIdle))
+
+	return nil
+}
+
+// Keys - keyring for signing and verification of tokens
+func Keys() *keyring.Keyring {
+	return keys
 }
 
 func TokenValidation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
-	if err := jwtValidate(r); err != nil {
-		w.WriteHeader(http.StatusForbidden)
+	if _, err := jwtValidate(r); err != nil {
+		WriteError(w, r, http.StatusUnauthorized, dao.ApiError{Code: dao.CodeUnauthorized})
 		return err
 	}
 
 	return nil
 }
 
-func MuxTokenValidation(w http.ResponseWriter, r *http.Request) error {
-	if err := jwtValidate(r); err != nil {
-		w.WriteHeader(http.StatusForbidden)
-		return err
+// MuxTokenValidation - authenticate request once, returned request carries claims in context.
+// Writes 401 when token is missing or invalid.
+func MuxTokenValidation(w http.ResponseWriter, r *http.Request) (*http.Request, error) {
+	claims, err := jwtValidate(r)
+
+	if err != nil {
+		WriteError(w, r, http.StatusUnauthorized, dao.ApiError{Code: dao.CodeUnauthorized})
+		return nil, err
 	}
 
-	return nil
+	return r.WithContext(WithClaims(r.Context(), claims)), nil
+}
+
+func jwtValidate(r *http.Request) (*dao.JwtClaims, error) {
+	return ValidateToken(r.Header.Get(authHeader))
 }
 
-func jwtValidate(r *http.Request) error {
-	tokenString := r.Header.Get(authHeader)
+// ValidateToken - parse access token string and check standard claims
+func ValidateToken(tokenString string) (*dao.JwtClaims, error) {
+	return parseToken(tokenString, dao.TokenAccess)
+}
 
+// ValidateRefreshToken - parse refresh token string and check standard claims
+func ValidateRefreshToken(tokenString string) (*dao.JwtClaims, error) {
+	return parseToken(tokenString, dao.TokenRefresh)
+}
+
+// ValidateMfaToken - parse token of login waiting for second factor
+func ValidateMfaToken(tokenString string) (*dao.JwtClaims, error) {
+	return parseToken(tokenString, dao.TokenMfaPending)
+}
+
+// parseToken - signature and time claims are checked by parser, see dao.JwtClaims.Valid
+func parseToken(tokenString string, typ string) (*dao.JwtClaims, error) {
 	if tokenString == "" {
-		return errors.New("token is empty")
+		return nil, errors.New("token is empty")
 	}
 
 	claims := dao.JwtClaims{}
 	_, err := jwt.ParseWithClaims(
 		tokenString,
 		&claims,
-		func(token *jwt.Token) (interface{}, error) {
-			return []byte(config.JwtSign), nil
-		},
+		keys.Keyfunc,
 	)
 
 	if err != nil {
 		log.Println("JWT error:", err)
-		return fmt.Errorf("parse JWT error: %s", err)
+		return nil, fmt.Errorf("parse JWT error: %s", err)
 	}
-	if claims.Exp == 0 || claims.Exp < time.Now().Unix() {
-		return errors.New("JWT is expired")
+	if claims.Typ != typ {
+		return nil, fmt.Errorf("JWT type %q is not %q", claims.Typ, typ)
+	}
+	if typ == dao.TokenAccess && !sessions.Check(claims.Family) {
+		return nil, errors.New("session is revoked")
 	}
 
-	return nil
+	return &claims, nil
 }
@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"server/model/dao"
+	"server/service"
+
+	"github.com/dgrijalva/jwt-go"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/stretchr/testify/assert"
+)
+
+const connectionString = "middleware_test.sqlite"
+
+var cfg = &dao.Config{
+	Driver:           "sqlite3",
+	ConnectionString: connectionString,
+	JwtSign:          "123456",
+}
+
+func setup(t *testing.T) dao.Session {
+	if err := service.Setup(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := Setup(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := service.NewDbSessionService().Create(dao.Session{UserID: 1})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return session
+}
+
+func sign(claims dao.JwtClaims) string {
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(cfg.JwtSign))
+
+	return token
+}
+
+func validate(token string) (int, *dao.JwtClaims) {
+	var claims *dao.JwtClaims
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/chats", nil)
+	r.Header.Set(authHeader, token)
+
+	if r, err := MuxTokenValidation(w, r); err == nil {
+		claims, _ = ClaimsFrom(r.Context())
+	}
+
+	return w.Code, claims
+}
+
+func TestMuxTokenValidation(t *testing.T) {
+	session := setup(t)
+	defer os.Remove(connectionString)
+	defer service.Close()
+
+	now := time.Now()
+	valid := dao.JwtClaims{
+		Id:     1,
+		Exp:    now.Add(time.Hour).Unix(),
+		Iat:    now.Unix(),
+		Typ:    dao.TokenAccess,
+		Family: session.Family,
+	}
+
+	status, claims := validate(sign(valid))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, int64(1), claims.Id)
+
+	expired := valid
+	expired.Exp = now.Add(-time.Minute).Unix()
+	notYet := valid
+	notYet.Nbf = now.Add(time.Hour).Unix()
+	refresh := valid
+	refresh.Typ = dao.TokenRefresh
+	noSession := valid
+	noSession.Family = "unknown"
+
+	noSubject := valid
+	noSubject.Id = 0
+
+	for _, item := range []dao.JwtClaims{expired, notYet, refresh, noSession, noSubject} {
+		status, claims = validate(sign(item))
+		assert.Equal(t, http.StatusUnauthorized, status)
+		assert.Nil(t, claims)
+	}
+
+	status, _ = validate("")
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
+
+func TestClaimsPayload(t *testing.T) {
+	token := sign(dao.JwtClaims{
+		Id:     7,
+		Exp:    100,
+		Nbf:    50,
+		Iat:    50,
+		Typ:    dao.TokenAccess,
+		Family: "family",
+	})
+	parts := strings.Split(token, ".")
+
+	if !assert.Len(t, parts, 3) {
+		return
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	assert.Nil(t, err)
+
+	// standard verifiers read registered claims only
+	payload := make(map[string]interface{})
+	assert.Nil(t, json.Unmarshal(data, &payload))
+	assert.Equal(t, map[string]interface{}{
+		"sub": float64(7),
+		"exp": float64(100),
+		"nbf": float64(50),
+		"iat": float64(50),
+		"typ": dao.TokenAccess,
+		"fam": "family",
+	}, payload)
+}
@@ -0,0 +1,188 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/model/dao"
+	"server/ratelimit"
+)
+
+const (
+	defaultAuthRateLimit    = 20
+	defaultAuthRateBurst    = 10
+	defaultLoginRateLimit   = 5
+	defaultLoginRateBurst   = 5
+	defaultLockoutThreshold = 5
+	defaultLockoutBase      = 30
+	defaultLockoutMax       = 60 * 60
+	defaultApiRateLimit     = 120
+	defaultApiRateBurst     = 30
+
+	// maxLoginBody - auth body is read twice, once here for login
+	maxLoginBody = 1 << 16
+	// storeIdle - keys of memory store without requests for this time are forgotten
+	storeIdle = time.Hour
+)
+
+var authLimiter, loginLimiter, apiLimiter *ratelimit.Limiter
+var lockout *ratelimit.Lockout
+
+// SetupRateLimit - create limiters on store, in-memory store is used by Setup
+func SetupRateLimit(cfg *dao.Config, store ratelimit.Store) {
+	authLimiter = ratelimit.NewLimiter(store, "auth:",
+		orDefault(cfg.AuthRateLimit, defaultAuthRateLimit), orDefault(cfg.AuthRateBurst, defaultAuthRateBurst))
+	loginLimiter = ratelimit.NewLimiter(store, "login:",
+		orDefault(cfg.LoginRateLimit, defaultLoginRateLimit), orDefault(cfg.LoginRateBurst, defaultLoginRateBurst))
+	apiLimiter = ratelimit.NewLimiter(store, "api:",
+		orDefault(cfg.ApiRateLimit, defaultApiRateLimit), orDefault(cfg.ApiRateBurst, defaultApiRateBurst))
+	lockout = ratelimit.NewLockout(store, "lockout:",
+		orDefault(cfg.LockoutThreshold, defaultLockoutThreshold),
+		time.Duration(orDefault(cfg.LockoutBase, defaultLockoutBase))*time.Second,
+		time.Duration(orDefault(cfg.LockoutMax, defaultLockoutMax))*time.Second)
+}
+
+// LimitAuth - throttle login and registration by ip and login.
+// Failed logins lock the login out for growing time. Failures are counted here,
+// success is reported by handler with LoginSucceeded once tokens are issued,
+// so password alone doesn't reset failures of second factor.
+func LimitAuth(w http.ResponseWriter, r *http.Request, handler http.HandlerFunc) {
+	login := peekLogin(r)
+
+	if login != "" {
+		if wait := lockout.Locked(login); wait > 0 {
+			TooManyRequests(w, r, wait)
+			return
+		}
+	}
+	if ok, wait := authLimiter.Allow(ClientIP(r)); !ok {
+		TooManyRequests(w, r, wait)
+		return
+	}
+	if login != "" {
+		if ok, wait := loginLimiter.Allow(login); !ok {
+			TooManyRequests(w, r, wait)
+			return
+		}
+	}
+
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	handler(recorder, r)
+
+	if login == "" {
+		return
+	}
+
+	if recorder.status == http.StatusNotFound || recorder.status == http.StatusUnauthorized {
+		lockout.Fail(login)
+	}
+}
+
+// LoginLocked - time left until login is unlocked
+func LoginLocked(login string) time.Duration {
+	return lockout.Locked(strings.ToLower(login))
+}
+
+// LoginFailed - count failure of login outside of LimitAuth, like wrong second factor
+func LoginFailed(login string) {
+	lockout.Fail(strings.ToLower(login))
+}
+
+// LoginSucceeded - forget failures of login, tokens are issued
+func LoginSucceeded(login string) {
+	lockout.Success(strings.ToLower(login))
+}
+
+// LimitApi - throttle authenticated user, false when request is rejected with 429
+func LimitApi(w http.ResponseWriter, r *http.Request) bool {
+	key := ClientIP(r)
+
+	if claims, ok := ClaimsFrom(r.Context()); ok {
+		key = strconv.FormatInt(claims.Id, 10)
+	}
+	if ok, wait := apiLimiter.Allow(key); !ok {
+		TooManyRequests(w, r, wait)
+		return false
+	}
+
+	return true
+}
+
+// ClientIP - address of client without port, proxy headers are not trusted
+func ClientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return ip
+}
+
+// TooManyRequests - 429 with Retry-After of at least a second
+func TooManyRequests(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	WriteError(w, r, http.StatusTooManyRequests, dao.ApiError{Code: dao.CodeRateLimited})
+}
+
+// peekLogin - login from JSON body, body is restored for handler
+func peekLogin(r *http.Request) string {
+	if r.Body == nil {
+		return ""
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxLoginBody))
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+
+	if err != nil {
+		return ""
+	}
+
+	data := struct {
+		Login string `json:"login"`
+	}{}
+
+	if err := json.Unmarshal(body, &data); err != nil {
+		return ""
+	}
+
+	return strings.ToLower(data.Login)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func orDefault(value int, def int) int {
+	if value <= 0 {
+		return def
+	}
+
+	return value
+}
+
+// statusRecorder - remembers status written by handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"server/model/dao"
+	"server/ratelimit"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func auth(body string, status int) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/login", strings.NewReader(body))
+
+	LimitAuth(w, r, func(w http.ResponseWriter, r *http.Request) {
+		// handler still gets the whole body
+		data, _ := ioutil.ReadAll(r.Body)
+
+		if string(data) != body {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(status)
+	})
+
+	return w
+}
+
+func TestLimitAuth(t *testing.T) {
+	SetupRateLimit(&dao.Config{
+		AuthRateBurst:    100,
+		LoginRateBurst:   100,
+		LockoutThreshold: 2,
+	}, ratelimit.NewMemoryStore(time.Hour))
+
+	assert.Equal(t, http.StatusNotFound, auth(`{"login":"user_0"}`, http.StatusNotFound).Code)
+	assert.Equal(t, http.StatusOK, auth(`{"login":"user_0"}`, http.StatusOK).Code)
+
+	// issued tokens reset failures
+	LoginSucceeded("User_0")
+	assert.Equal(t, http.StatusNotFound, auth(`{"login":"user_0"}`, http.StatusNotFound).Code)
+	assert.Equal(t, time.Duration(0), LoginLocked("user_0"))
+
+	// success status alone doesn't, it may be pending second factor
+	assert.Equal(t, http.StatusOK, auth(`{"login":"user_0"}`, http.StatusOK).Code)
+	LoginFailed("user_0")
+	assert.True(t, LoginLocked("user_0") > 0)
+
+	w := auth(`{"login":"USER_0"}`, http.StatusOK)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+
+	assert.Equal(t, http.StatusOK, auth(`{"login":"user_1"}`, http.StatusOK).Code)
+}
+
+func TestLimitAuthByIP(t *testing.T) {
+	SetupRateLimit(&dao.Config{
+		AuthRateBurst: 2,
+	}, ratelimit.NewMemoryStore(time.Hour))
+
+	assert.Equal(t, http.StatusOK, auth(`{"login":"user_0"}`, http.StatusOK).Code)
+	assert.Equal(t, http.StatusOK, auth(`{"login":"user_1"}`, http.StatusOK).Code)
+
+	w := auth(`{"login":"user_2"}`, http.StatusOK)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+}
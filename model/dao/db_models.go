@@ -0,0 +1,124 @@
+package dao
+
+import "time"
+
+// ReadCursor - last message read by member of chat
+type ReadCursor struct {
+	ID        int64     `json:"-"`
+	ChatID    int64     `json:"chat_id" gorm:"unique_index:idx_read_cursor_chat_user"`
+	UserID    int64     `json:"user_id" gorm:"unique_index:idx_read_cursor_chat_user"`
+	MessageID int64     `json:"message_id"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ChatSettings - chat options kept by server, avatar is a reference to image
+type ChatSettings struct {
+	ID          int64     `json:"-"`
+	ChatID      int64     `json:"chat_id" gorm:"unique_index"`
+	MessageTTL  int64     `json:"message_ttl"`
+	Description string    `json:"description"`
+	Avatar      string    `json:"avatar"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// ChatRole - role of chat member kept by server, owner is taken from chat
+type ChatRole struct {
+	ID        int64     `json:"-"`
+	ChatID    int64     `json:"chat_id" gorm:"unique_index:idx_chat_role_chat_user"`
+	UserID    int64     `json:"user_id" gorm:"unique_index:idx_chat_role_chat_user"`
+	Role      string    `json:"role"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// MessageRevision - previous text of edited message
+type MessageRevision struct {
+	ID        int64     `json:"id"`
+	MessageID int64     `json:"message_id" gorm:"index"`
+	Text      string    `json:"text"`
+	EditedAt  time.Time `json:"edited_at"`
+}
+
+// RefreshToken - issued refresh token, every token can be used once.
+// Tokens issued by rotation share family of the first one.
+type RefreshToken struct {
+	ID        int64  `gorm:"primary_key"`
+	Jti       string `gorm:"unique_index"`
+	Family    string `gorm:"index"`
+	UserID    int64  `gorm:"index"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
+
+// Session - login of user on device, tokens of session share its family
+type Session struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"-" gorm:"index"`
+	Family     string     `json:"-" gorm:"unique_index"`
+	DeviceName string     `json:"device_name"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt time.Time  `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"-"`
+	Duress     bool       `json:"-"`
+	Current    bool       `json:"current" gorm:"-"`
+}
+
+// DuressEvent - login with reset password, kept for review by owner
+type DuressEvent struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"-" gorm:"index"`
+	Action     string     `json:"action"`
+	Chats      int        `json:"chats"`
+	DeviceName string     `json:"device_name"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ReviewedAt *time.Time `json:"reviewed_at"`
+}
+
+// Mfa - TOTP of user, enabled after confirmation by first code
+type Mfa struct {
+	ID          int64 `gorm:"primary_key"`
+	UserID      int64 `gorm:"unique_index"`
+	Secret      string
+	LastStep    int64
+	ConfirmedAt *time.Time
+	CreatedAt   time.Time
+}
+
+// RecoveryCode - one-time replacement of TOTP code, only hash is kept
+type RecoveryCode struct {
+	ID     int64  `gorm:"primary_key"`
+	UserID int64  `gorm:"index"`
+	Hash   string `gorm:"index"`
+	UsedAt *time.Time
+}
+
+// MfaChallenge - login with password waiting for second factor
+type MfaChallenge struct {
+	ID         int64  `gorm:"primary_key"`
+	Jti        string `gorm:"unique_index"`
+	UserID     int64
+	Duress     bool
+	DeviceName string
+	Attempts   int
+	ExpiresAt  time.Time
+	UsedAt     *time.Time
+}
+
+// ChatInvite - link which adds its holder to group chat, only hash of token is kept.
+// Zero MaxUses is unlimited.
+type ChatInvite struct {
+	ID        int64      `json:"id"`
+	ChatID    int64      `json:"chat_id" gorm:"index"`
+	Hash      string     `json:"-" gorm:"unique_index"`
+	CreatedBy int64      `json:"created_by"`
+	MaxUses   int        `json:"max_uses"`
+	Uses      int        `json:"uses"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
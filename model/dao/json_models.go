@@ -1,9 +1,10 @@
 package dao
 
 import (
-	"server/core/ewc"
+	"errors"
+	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"server/core/ewc"
 )
 
 // Config - app config
@@ -13,28 +14,400 @@ type Config struct {
 	ConnectionString string `json:"connection_string"`
 	JwtSign          string `json:"jwt_sign"`
 	PageLimit        int    `json:"page_limit"`
+	ReaperInterval   int    `json:"reaper_interval"`
+	ReaperBatchSize  int    `json:"reaper_batch_size"`
+	MinMessageTTL    int64  `json:"min_message_ttl"`
+	MaxMessageTTL    int64  `json:"max_message_ttl"`
+	MessageRevisions int    `json:"message_revisions"`
+	// http server, timeouts in seconds
+	ReadTimeout       int `json:"read_timeout"`
+	ReadHeaderTimeout int `json:"read_header_timeout"`
+	WriteTimeout      int `json:"write_timeout"`
+	IdleTimeout       int `json:"idle_timeout"`
+	MaxHeaderBytes    int `json:"max_header_bytes"`
+	ShutdownTimeout   int `json:"shutdown_timeout"`
+	// https is served when certificate is set, redirect address is plain http listener
+	TLSCertFile     string `json:"tls_cert_file"`
+	TLSKeyFile      string `json:"tls_key_file"`
+	RedirectAddress string `json:"redirect_address"`
+	// first key signs tokens, next JwtPreviousKeys keys only verify them (0 - all).
+	// JwtSign verifies tokens without kid and signs when there are no keys.
+	JwtKeys         []JwtKey `json:"jwt_keys"`
+	JwtPreviousKeys int      `json:"jwt_previous_keys"`
+	// what happens to chats on login with reset password: hide (default) or wipe
+	DuressAction string `json:"duress_action"`
+	// rate limits in requests per minute; login and registration per ip and per login,
+	// lockout of login after failures in seconds, api limits per user of write routes
+	AuthRateLimit    int `json:"auth_rate_limit"`
+	AuthRateBurst    int `json:"auth_rate_burst"`
+	LoginRateLimit   int `json:"login_rate_limit"`
+	LoginRateBurst   int `json:"login_rate_burst"`
+	LockoutThreshold int `json:"lockout_threshold"`
+	LockoutBase      int `json:"lockout_base"`
+	LockoutMax       int `json:"lockout_max"`
+	ApiRateLimit     int `json:"api_rate_limit"`
+	ApiRateBurst     int `json:"api_rate_burst"`
+	// bcrypt cost of changed passwords, minimum length of new passwords
+	BcryptCost        int `json:"bcrypt_cost"`
+	PasswordMinLength int `json:"password_min_length"`
+	// issuer shown by authenticator apps
+	MfaIssuer string `json:"mfa_issuer"`
+	// messages of deleted account: delete (default) or anonymize
+	DeletedMessages string `json:"deleted_messages"`
+	// limits of request bodies; lengths in characters, charsets are regexp
+	// character classes which every character has to match
+	MaxBodyBytes         int64  `json:"max_body_bytes"`
+	LoginMinLength       int    `json:"login_min_length"`
+	LoginMaxLength       int    `json:"login_max_length"`
+	LoginCharset         string `json:"login_charset"`
+	ChatNameMaxLength    int    `json:"chat_name_max_length"`
+	ChatNameCharset      string `json:"chat_name_charset"`
+	MessageTextMaxLength int    `json:"message_text_max_length"`
+	MessageTextCharset   string `json:"message_text_charset"`
+	// chat description, charset is the same as of message text
+	ChatDescriptionMaxLength int `json:"chat_description_max_length"`
+	// invite links, default and maximal lifetime in seconds
+	InviteLifeTime    int64 `json:"invite_life_time"`
+	InviteMaxLifeTime int64 `json:"invite_max_life_time"`
+}
+
+// JwtKey - signing key, HS256 uses secret, RS256 and EdDSA use PEM files
+type JwtKey struct {
+	ID             string `json:"id"`
+	Algorithm      string `json:"algorithm"`
+	Secret         string `json:"secret"`
+	PrivateKeyFile string `json:"private_key_file"`
+	PublicKeyFile  string `json:"public_key_file"`
 }
 
+// SystemUserID - author of service messages in chats
+const SystemUserID int64 = 0
+
+// DeletedUserID - author of anonymized messages of deleted accounts
+const DeletedUserID int64 = -1
+
+// what happens to messages of deleted account
+const (
+	MessagesDelete    = "delete"
+	MessagesAnonymize = "anonymize"
+)
+
+// ApiError - body of every error response, code is stable and meant for clients,
+// error is a message for humans
 type ApiError struct {
-	Error string `json:"error,omitempty"`
+	Code      string       `json:"code"`
+	Error     string       `json:"error,omitempty"`
+	Fields    []FieldError `json:"fields,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
 }
 
+// FieldError - invalid field of request body
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// error codes of ApiError
+const (
+	CodeBadRequest         = "bad_request"
+	CodeInvalidJSON        = "invalid_json"
+	CodeBodyTooLarge       = "body_too_large"
+	CodeValidationFailed   = "validation_failed"
+	CodeUnauthorized       = "unauthorized"
+	CodeInvalidCredentials = "invalid_credentials"
+	CodeInvalidCode        = "invalid_code"
+	CodeWrongPassword      = "wrong_password"
+	CodeForbidden          = "forbidden"
+	CodeNotMember          = "not_member"
+	CodeNoPermission       = "no_permission"
+	CodeNotAuthor          = "not_author"
+	CodeNotFriend          = "not_friend"
+	CodeNotFound           = "not_found"
+	CodeUserNotFound       = "user_not_found"
+	CodeChatNotFound       = "chat_not_found"
+	CodeMessageNotFound    = "message_not_found"
+	CodeSessionNotFound    = "session_not_found"
+	CodeFriendNotFound     = "friend_not_found"
+	CodeMemberNotFound     = "member_not_found"
+	CodeMfaNotFound        = "mfa_not_found"
+	CodeInviteNotFound     = "invite_not_found"
+	CodeMethodNotAllowed   = "method_not_allowed"
+	CodeLoginTaken         = "login_taken"
+	CodeAlreadyFriends     = "already_friends"
+	CodeAlreadyMember      = "already_member"
+	CodeOwnerCantExit      = "owner_cant_exit"
+	CodeMfaEnabled         = "mfa_enabled"
+	CodeVersionConflict    = "version_conflict"
+	CodePreconditionFailed = "precondition_failed"
+	CodeInviteExpired      = "invite_expired"
+	CodeRateLimited        = "rate_limited"
+	CodeNotImplemented     = "not_implemented"
+	CodeInternal           = "internal_error"
+)
+
+// field error codes of FieldError
+const (
+	FieldRequired = "required"
+	FieldInvalid  = "invalid"
+	FieldTooShort = "too_short"
+	FieldTooLong  = "too_long"
+	FieldTooWeak  = "too_common"
+	FieldSame     = "same_as_password"
+)
+
 type AuthData struct {
 	Token        string `json:"token"`
 	RefreshToken string `json:"refresh_token"`
+	// not reviewed logins with reset password, never set for such logins
+	DuressEvents int `json:"duress_events,omitempty"`
+}
+
+// Credentials - body of login
+type Credentials struct {
+	Login      string `json:"login"`
+	Password   string `json:"password"`
+	DeviceName string `json:"device_name"`
 }
 
+// Registration - body of registration, reset password is used for login under duress
+type Registration struct {
+	Login         string `json:"login"`
+	Password      string `json:"password"`
+	ResetPassword string `json:"reset_password"`
+	DeviceName    string `json:"device_name"`
+}
+
+// FriendRequest - friend is added by login
+type FriendRequest struct {
+	Login string `json:"login"`
+}
+
+type RefreshData struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// MfaPending - first step of login when two-factor authentication is enabled
+type MfaPending struct {
+	MfaToken string `json:"mfa_token"`
+}
+
+// MfaLogin - second step of login, either code or recovery code is required
+type MfaLogin struct {
+	MfaToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// MfaEnrollment - secret of new TOTP, enabled after confirmation
+type MfaEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// MfaCode - code of TOTP or recovery code
+type MfaCode struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// RecoveryCodes - shown once after confirmation of TOTP
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// AccountDeletion - current password confirms deletion
+type AccountDeletion struct {
+	Password string `json:"password"`
+}
+
+// Export - data of user, chats contain only own messages
+type Export struct {
+	Profile  ewc.User      `json:"profile"`
+	Friends  []ewc.User    `json:"friends"`
+	Chats    []*ewc.Chat   `json:"chats"`
+	Messages []ewc.Message `json:"messages"`
+	Sessions []Session     `json:"sessions"`
+}
+
+// PasswordChange - new password or reset password, current password is required
+type PasswordChange struct {
+	CurrentPassword string `json:"current_password"`
+	Password        string `json:"password"`
+	ResetPassword   string `json:"reset_password"`
+}
+
+// token types
+const (
+	TokenAccess  = "access"
+	TokenRefresh = "refresh"
+	// TokenMfaPending - password is checked, can only be exchanged at /login/mfa
+	TokenMfaPending = "mfa_pending"
+)
+
+// duress actions, hide exits all chats, wipe also deletes their messages
+const (
+	DuressHide = "hide"
+	DuressWipe = "wipe"
+)
+
+// clockSkew - allowed difference of clocks for nbf and iat
+const clockSkew = 30
+
+// JwtClaims - registered claims of JWT, user id is subject
 type JwtClaims struct {
-	*jwt.MapClaims
-	Id  int64
-	Exp int64
+	Id     int64  `json:"sub"`
+	Exp    int64  `json:"exp"`
+	Nbf    int64  `json:"nbf,omitempty"`
+	Iat    int64  `json:"iat,omitempty"`
+	Typ    string `json:"typ,omitempty"`
+	Jti    string `json:"jti,omitempty"`
+	Family string `json:"fam,omitempty"`
 }
 
-func (JwtClaims) Valid() error {
+// Valid - subject and expiration are required, nbf and iat are checked when set
+func (claims JwtClaims) Valid() error {
+	now := time.Now().Unix()
+
+	// zero is system user, tokens without subject must not act as it
+	if claims.Id == 0 {
+		return errors.New("token has no subject")
+	}
+
+	if claims.Exp == 0 || claims.Exp < now {
+		return errors.New("token is expired")
+	}
+	if claims.Nbf != 0 && claims.Nbf > now+clockSkew {
+		return errors.New("token is not valid yet")
+	}
+	if claims.Iat != 0 && claims.Iat > now+clockSkew {
+		return errors.New("token is issued in the future")
+	}
+
 	return nil
 }
 
+// JSONWebKey - public key in JWK format
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
 type ChatData struct {
 	ewc.Chat
 	UnreadCount int `json:"unread_count"`
 }
+
+type ChatDetails struct {
+	ewc.Chat
+	MessageTTL  int64        `json:"message_ttl"`
+	Description string       `json:"description,omitempty"`
+	Avatar      string       `json:"avatar,omitempty"`
+	ReadState   []ReadCursor `json:"read_state,omitempty"`
+	// role of current user, roles of others are included on request
+	Role  string     `json:"role,omitempty"`
+	Roles []ChatRole `json:"roles,omitempty"`
+}
+
+// ChatPatch - partial update of chat, nil fields are not changed
+type ChatPatch struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	Avatar      *string `json:"avatar"`
+	MessageTTL  *int64  `json:"message_ttl"`
+}
+
+// roles of chat members, from most to least powerful
+const (
+	RoleOwner    = "owner"
+	RoleAdmin    = "admin"
+	RoleMember   = "member"
+	RoleReadOnly = "read_only"
+)
+
+// RoleChange - new role of chat member, owner is changed by transfer only
+type RoleChange struct {
+	Role string `json:"role"`
+}
+
+// OwnerTransfer - member who becomes owner of chat
+type OwnerTransfer struct {
+	UserID int64 `json:"user_id"`
+}
+
+// InviteCreation - options of new invite link; zero expires_in is default lifetime,
+// zero max_uses is unlimited
+type InviteCreation struct {
+	ExpiresIn int64 `json:"expires_in"`
+	MaxUses   int   `json:"max_uses"`
+}
+
+// InviteData - created invite, token is shown only once
+type InviteData struct {
+	ChatInvite
+	Token string `json:"token"`
+}
+
+// MemberAddition - friend added to group chat
+type MemberAddition struct {
+	UserID int64 `json:"user_id"`
+}
+
+type ReadData struct {
+	MessageID int64 `json:"message_id"`
+}
+
+// event types pushed to chat members
+const (
+	EventMessageCreated = "message_created"
+	EventMessageDeleted = "message_deleted"
+	EventChatCleaned    = "chat_cleaned"
+	EventChatExited     = "chat_exited"
+	EventChatJoined     = "chat_joined"
+	EventRoleChanged    = "role_changed"
+	EventChatUpdated    = "chat_updated"
+	EventMessagesRead   = "messages_read"
+	EventMessageEdited  = "message_edited"
+	// missed events can't be replayed, client has to reload its state
+	EventReset = "reset"
+)
+
+// Event - envelope for realtime chat events
+type Event struct {
+	ID     int64       `json:"id"`
+	Type   string      `json:"type"`
+	ChatID int64       `json:"chat_id"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+// MessageData - message with edit info
+type MessageData struct {
+	ewc.Message
+	EditedAt  *time.Time        `json:"edited_at,omitempty"`
+	Revisions []MessageRevision `json:"revisions,omitempty"`
+}
+
+type MessageEdit struct {
+	Text string `json:"text"`
+}
+
+type MessageRef struct {
+	ID     int64 `json:"id"`
+	ChatID int64 `json:"chat_id"`
+}
+
+type ChatMemberRef struct {
+	ChatID int64  `json:"chat_id"`
+	UserID int64  `json:"user_id"`
+	Role   string `json:"role,omitempty"`
+}
@@ -0,0 +1,49 @@
+package password
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	// DefaultMinLength - used when config has no minimum
+	DefaultMinLength = 8
+	// MaxLength - bcrypt ignores bytes after 72
+	MaxLength = 72
+)
+
+var (
+	ErrTooShort = errors.New("password is too short")
+	ErrTooLong  = errors.New("password is too long")
+	// ErrBanned - password is in list of common passwords
+	ErrBanned = errors.New("password is too common")
+)
+
+// Policy - rules for new passwords
+type Policy struct {
+	MinLength int
+}
+
+// NewPolicy - create policy, zero length means default
+func NewPolicy(minLength int) Policy {
+	if minLength <= 0 {
+		minLength = DefaultMinLength
+	}
+
+	return Policy{MinLength: minLength}
+}
+
+// Check - error of first broken rule
+func (policy Policy) Check(password string) error {
+	if len([]rune(password)) < policy.MinLength {
+		return ErrTooShort
+	}
+	if len(password) > MaxLength {
+		return ErrTooLong
+	}
+	if _, ok := banned[strings.ToLower(password)]; ok {
+		return ErrBanned
+	}
+
+	return nil
+}
@@ -0,0 +1,22 @@
+package password
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	policy := NewPolicy(0)
+
+	assert.Nil(t, policy.Check("password_999"))
+	assert.Equal(t, ErrTooShort, policy.Check("short"))
+	assert.Equal(t, ErrTooLong, policy.Check(strings.Repeat("a", MaxLength+1)))
+	assert.Equal(t, ErrBanned, policy.Check("Password1"))
+	assert.Equal(t, ErrBanned, policy.Check("qwertyuiop"))
+
+	// length is counted in characters
+	assert.Nil(t, NewPolicy(4).Check("пароль"))
+	assert.NotNil(t, NewPolicy(10).Check("пароль"))
+}
@@ -0,0 +1,126 @@
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// Limiter - token bucket per key, bucket of burst size is refilled with rate tokens per second
+type Limiter struct {
+	store  Store
+	prefix string
+	rate   float64
+	burst  float64
+	now    func() time.Time
+}
+
+// NewLimiter - create limiter, prefix separates its keys in shared store
+func NewLimiter(store Store, prefix string, perMinute int, burst int) *Limiter {
+	limiter := new(Limiter)
+	limiter.store = store
+	limiter.prefix = prefix
+	limiter.rate = float64(perMinute) / 60
+	limiter.burst = float64(burst)
+	limiter.now = time.Now
+
+	return limiter
+}
+
+// Allow - take token for key, when bucket is empty returns time until next token
+func (limiter *Limiter) Allow(key string) (bool, time.Duration) {
+	now := limiter.now()
+	allowed := false
+	state := limiter.store.Update(limiter.prefix+key, func(state *State) {
+		if state.UpdatedAt.IsZero() {
+			state.Tokens = limiter.burst
+		} else {
+			elapsed := now.Sub(state.UpdatedAt).Seconds()
+			state.Tokens = math.Min(limiter.burst, state.Tokens+elapsed*limiter.rate)
+		}
+
+		state.UpdatedAt = now
+
+		if state.Tokens >= 1 {
+			state.Tokens--
+			allowed = true
+		}
+	})
+
+	if allowed {
+		return true, 0
+	}
+
+	wait := (1 - state.Tokens) / limiter.rate
+
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// Lockout - locks key after threshold failures, every next failure doubles lock time
+type Lockout struct {
+	store     Store
+	prefix    string
+	threshold int
+	base      time.Duration
+	max       time.Duration
+	now       func() time.Time
+}
+
+// NewLockout - create lockout, lock time grows from base to max
+func NewLockout(store Store, prefix string, threshold int, base time.Duration, max time.Duration) *Lockout {
+	lockout := new(Lockout)
+	lockout.store = store
+	lockout.prefix = prefix
+	lockout.threshold = threshold
+	lockout.base = base
+	lockout.max = max
+	lockout.now = time.Now
+
+	return lockout
+}
+
+// Locked - time left until key is unlocked
+func (lockout *Lockout) Locked(key string) time.Duration {
+	now := lockout.now()
+	state, ok := lockout.store.Get(lockout.prefix + key)
+
+	if ok && now.Before(state.LockedUntil) {
+		return state.LockedUntil.Sub(now)
+	}
+
+	return 0
+}
+
+// Fail - count failure of key, returns lock time when key becomes locked
+func (lockout *Lockout) Fail(key string) time.Duration {
+	now := lockout.now()
+	state := lockout.store.Update(lockout.prefix+key, func(state *State) {
+		state.Failures++
+		state.UpdatedAt = now
+
+		if state.Failures < lockout.threshold {
+			return
+		}
+
+		lock := lockout.base
+
+		for i := lockout.threshold; i < state.Failures && lock < lockout.max; i++ {
+			lock *= 2
+		}
+		if lock > lockout.max {
+			lock = lockout.max
+		}
+
+		state.LockedUntil = now.Add(lock)
+	})
+
+	if now.Before(state.LockedUntil) {
+		return state.LockedUntil.Sub(now)
+	}
+
+	return 0
+}
+
+// Success - forget failures of key
+func (lockout *Lockout) Success(key string) {
+	lockout.store.Delete(lockout.prefix + key)
+}
@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func TestLimiter(t *testing.T) {
+	c := &clock{now: time.Now()}
+	limiter := NewLimiter(NewMemoryStore(time.Hour), "ip:", 60, 2)
+	limiter.now = c.Now
+
+	ok, _ := limiter.Allow("1.1.1.1")
+	assert.True(t, ok)
+	ok, _ = limiter.Allow("1.1.1.1")
+	assert.True(t, ok)
+
+	ok, wait := limiter.Allow("1.1.1.1")
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+
+	// other keys have own buckets
+	ok, _ = limiter.Allow("2.2.2.2")
+	assert.True(t, ok)
+
+	c.now = c.now.Add(time.Second)
+	ok, _ = limiter.Allow("1.1.1.1")
+	assert.True(t, ok)
+
+	// bucket is not refilled over burst
+	c.now = c.now.Add(time.Hour)
+	ok, _ = limiter.Allow("1.1.1.1")
+	assert.True(t, ok)
+	ok, _ = limiter.Allow("1.1.1.1")
+	assert.True(t, ok)
+	ok, _ = limiter.Allow("1.1.1.1")
+	assert.False(t, ok)
+}
+
+func TestLockout(t *testing.T) {
+	c := &clock{now: time.Now()}
+	lockout := NewLockout(NewMemoryStore(time.Hour), "login:", 3, time.Minute, 3*time.Minute)
+	lockout.now = c.Now
+
+	assert.Zero(t, lockout.Fail("user"))
+	assert.Zero(t, lockout.Fail("user"))
+	assert.Zero(t, lockout.Locked("user"))
+
+	assert.Equal(t, time.Minute, lockout.Fail("user"))
+	assert.Equal(t, time.Minute, lockout.Locked("user"))
+	assert.Zero(t, lockout.Locked("other"))
+
+	// lock time doubles up to max
+	assert.Equal(t, 2*time.Minute, lockout.Fail("user"))
+	assert.Equal(t, 3*time.Minute, lockout.Fail("user"))
+
+	c.now = c.now.Add(3 * time.Minute)
+	assert.Zero(t, lockout.Locked("user"))
+
+	lockout.Success("user")
+	assert.Zero(t, lockout.Fail("user"))
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	store := NewMemoryStore(time.Minute)
+	now := time.Now()
+
+	store.Update("old", func(state *State) {
+		state.UpdatedAt = now
+	})
+	store.Update("locked", func(state *State) {
+		state.UpdatedAt = now
+		state.LockedUntil = now.Add(time.Hour)
+	})
+	store.Update("new", func(state *State) {
+		state.UpdatedAt = now.Add(2 * sweepPeriod)
+	})
+
+	assert.Equal(t, 2, store.Len())
+	_, ok := store.Get("old")
+	assert.False(t, ok)
+}
@@ -0,0 +1,106 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// State - bucket and failures of single key
+type State struct {
+	Tokens      float64
+	Failures    int
+	LockedUntil time.Time
+	UpdatedAt   time.Time
+}
+
+// Store - keeps states of keys, shared store (e.g. redis) allows limits across instances
+type Store interface {
+	// Update - change state of key atomically and return the new one, missing key has zero state
+	Update(key string, fn func(state *State)) State
+	// Get - state of key, false when key is unknown
+	Get(key string) (State, bool)
+	// Delete - forget key
+	Delete(key string)
+}
+
+// sweepPeriod - how often idle keys are removed from memory store
+const sweepPeriod = time.Minute
+
+// MemoryStore - store of single instance
+type MemoryStore struct {
+	mu        sync.Mutex
+	states    map[string]*State
+	idle      time.Duration
+	lastSweep time.Time
+}
+
+// NewMemoryStore - create store, keys not updated for idle duration and not locked are removed
+func NewMemoryStore(idle time.Duration) *MemoryStore {
+	store := new(MemoryStore)
+	store.states = make(map[string]*State)
+	store.idle = idle
+	store.lastSweep = time.Now()
+
+	return store
+}
+
+// Update - change state of key under lock
+func (store *MemoryStore) Update(key string, fn func(state *State)) State {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	state, ok := store.states[key]
+
+	if !ok {
+		state = new(State)
+		store.states[key] = state
+	}
+
+	fn(state)
+	store.sweep(state.UpdatedAt)
+
+	return *state
+}
+
+// Get - state of key
+func (store *MemoryStore) Get(key string) (State, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if state, ok := store.states[key]; ok {
+		return *state, true
+	}
+
+	return State{}, false
+}
+
+// Delete - forget key
+func (store *MemoryStore) Delete(key string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.states, key)
+}
+
+// Len - number of kept keys
+func (store *MemoryStore) Len() int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return len(store.states)
+}
+
+// sweep - remove idle keys, must be called under lock
+func (store *MemoryStore) sweep(now time.Time) {
+	if now.Sub(store.lastSweep) < sweepPeriod {
+		return
+	}
+
+	store.lastSweep = now
+
+	for key, state := range store.states {
+		if now.Sub(state.UpdatedAt) > store.idle && now.After(state.LockedUntil) {
+			delete(store.states, key)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"time"
+
+	"server/core/ewc"
+	"server/model/dao"
+)
+
+// DbAccountService - data of user across core and server tables
+type DbAccountService struct{}
+
+// NewDbAccountService - create account service
+func NewDbAccountService() *DbAccountService {
+	return new(DbAccountService)
+}
+
+// GetMessages - messages written by user in all chats, oldest first
+func (s *DbAccountService) GetMessages(userID int64) []ewc.Message {
+	messages := make([]ewc.Message, 0)
+	db.Table("messages").
+		Where("messages.user_id = ?", userID).
+		Where(notExpired, time.Time{}, time.Now()).
+		Order("messages.id").
+		Find(&messages)
+
+	return messages
+}
+
+// Delete - remove user with memberships, friendships, sessions and server data in one transaction.
+// Messages are deleted or moved to dao.DeletedUserID when anonymize is set.
+// Group chats of user get the oldest admin, or the oldest member, as owner.
+func (s *DbAccountService) Delete(userID int64, anonymize bool) error {
+	tx := db.Begin()
+
+	if err := handOverChats(tx, userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	messages := tx.Unscoped().Model(&ewc.Message{}).Where("user_id = ?", userID)
+	var err error
+
+	if anonymize {
+		err = messages.Update("user_id", dao.DeletedUserID).Error
+	} else {
+		err = messages.Delete(&ewc.Message{}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	steps := []struct {
+		model interface{}
+		where string
+		args  []interface{}
+	}{
+		{&ewc.ChatUser{}, "user_id = ?", []interface{}{userID}},
+		{&ewc.Friend{}, "user_id = ? or friend_id = ?", []interface{}{userID, userID}},
+		{&dao.ReadCursor{}, "user_id = ?", []interface{}{userID}},
+		{&dao.ChatInvite{}, "created_by = ?", []interface{}{userID}},
+		{&dao.RefreshToken{}, "user_id = ?", []interface{}{userID}},
+		{&dao.Session{}, "user_id = ?", []interface{}{userID}},
+		{&dao.DuressEvent{}, "user_id = ?", []interface{}{userID}},
+		{&dao.Mfa{}, "user_id = ?", []interface{}{userID}},
+		{&dao.RecoveryCode{}, "user_id = ?", []interface{}{userID}},
+		{&dao.MfaChallenge{}, "user_id = ?", []interface{}{userID}},
+		{&ewc.User{}, "id = ?", []interface{}{userID}},
+	}
+
+	for _, step := range steps {
+		if err := tx.Unscoped().Where(step.where, step.args...).Delete(step.model).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit().Error
+}
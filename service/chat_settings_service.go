@@ -0,0 +1,64 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"server/core/ewc"
+	"server/model/dao"
+)
+
+// ErrVersionConflict - chat was changed by other request
+var ErrVersionConflict = errors.New("chat was changed")
+
+// DbChatSettingsService - chat options kept by server
+type DbChatSettingsService struct{}
+
+// NewDbChatSettingsService - create chat settings service
+func NewDbChatSettingsService() *DbChatSettingsService {
+	return new(DbChatSettingsService)
+}
+
+// Get - settings of chat, defaults if chat has none
+func (s *DbChatSettingsService) Get(chatID int64) dao.ChatSettings {
+	settings := dao.ChatSettings{}
+	db.Where("chat_id = ?", chatID).First(&settings)
+	settings.ChatID = chatID
+
+	return settings
+}
+
+// Update - save settings and name of chat together, nil name is kept.
+// Update time of chat is the version of chat, it's moved by update. Chat changed
+// since version was read is not updated, ErrVersionConflict is returned.
+func (s *DbChatSettingsService) Update(settings dao.ChatSettings, name *string, version time.Time) (dao.ChatSettings, error) {
+	now := time.Now()
+	fields := map[string]interface{}{"updated_at": now}
+
+	if name != nil {
+		fields["name"] = *name
+	}
+
+	existing := s.Get(settings.ChatID)
+	settings.ID = existing.ID
+	settings.UpdatedAt = now
+	tx := db.Begin()
+	result := tx.Model(&ewc.Chat{}).
+		Where("id = ? AND updated_at = ?", settings.ChatID, version).
+		Updates(fields)
+
+	if result.Error != nil {
+		tx.Rollback()
+		return existing, result.Error
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return existing, ErrVersionConflict
+	}
+	if err := tx.Save(&settings).Error; err != nil {
+		tx.Rollback()
+		return existing, err
+	}
+
+	return settings, tx.Commit().Error
+}
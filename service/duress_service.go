@@ -0,0 +1,59 @@
+package service
+
+import (
+	"time"
+
+	"server/model/dao"
+)
+
+// DbDuressService - logins with reset password
+type DbDuressService struct{}
+
+// NewDbDuressService - create duress service
+func NewDbDuressService() *DbDuressService {
+	return new(DbDuressService)
+}
+
+// Record - save login with reset password
+func (s *DbDuressService) Record(event dao.DuressEvent) (dao.DuressEvent, error) {
+	event.CreatedAt = time.Now()
+	err := db.Create(&event).Error
+
+	return event, err
+}
+
+// HandOverChats - before user silently leaves chats, group chats owned by user
+// get successors and roles of user are removed, in one transaction
+func (s *DbDuressService) HandOverChats(userID int64) error {
+	tx := db.Begin()
+
+	if err := handOverChats(tx, userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// GetForUser - events of user, newest first
+func (s *DbDuressService) GetForUser(userID int64) []dao.DuressEvent {
+	events := make([]dao.DuressEvent, 0)
+	db.Where("user_id = ?", userID).Order("id desc").Find(&events)
+
+	return events
+}
+
+// CountNotReviewed - number of events owner hasn't seen yet
+func (s *DbDuressService) CountNotReviewed(userID int64) int {
+	count := 0
+	db.Model(&dao.DuressEvent{}).Where("user_id = ? and reviewed_at is null", userID).Count(&count)
+
+	return count
+}
+
+// Review - mark all events of user as seen by owner
+func (s *DbDuressService) Review(userID int64) error {
+	return db.Model(&dao.DuressEvent{}).
+		Where("user_id = ? and reviewed_at is null", userID).
+		Update("reviewed_at", time.Now()).Error
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"time"
+
+	"server/core/ewc"
+)
+
+// notExpired - condition for messages which are not expired at given time,
+// params are zero time and current time
+const notExpired = "(messages.expired_at is null or messages.expired_at <= ? or messages.expired_at > ?)"
+
+// legacyPageSize - size of pages by number, same as in core
+const legacyPageSize = 20
+
+// DbHistoryService - keyset pagination of chat messages
+type DbHistoryService struct{}
+
+// NewDbHistoryService - create history service
+func NewDbHistoryService() *DbHistoryService {
+	return new(DbHistoryService)
+}
+
+// GetByCursor - up to limit messages of chat between after and before ids, newest first.
+// Zero id means no bound. With after id messages closest to it are taken, otherwise closest to before id.
+func (s *DbHistoryService) GetByCursor(chatID int64, beforeID int64, afterID int64, limit int) ([]ewc.Message, error) {
+	messages := make([]ewc.Message, 0, limit)
+	query := db.Table("messages").
+		Where("messages.chat_id = ?", chatID).
+		Where(notExpired, time.Time{}, time.Now()).
+		Limit(limit)
+
+	if beforeID > 0 {
+		query = query.Where("messages.id < ?", beforeID)
+	}
+	if afterID == 0 {
+		err := query.Order("messages.id desc").Find(&messages).Error
+
+		return messages, err
+	}
+	if err := query.Where("messages.id > ?", afterID).Order("messages.id asc").Find(&messages).Error; err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+
+	return messages, nil
+}
+
+// GetByPage - page of chat messages by number for old clients, newest first.
+// Expired messages are skipped by query, so pages stay full until the last one.
+func (s *DbHistoryService) GetByPage(chatID int64, page int) ([]ewc.Message, error) {
+	messages := make([]ewc.Message, 0, legacyPageSize)
+	err := db.Table("messages").
+		Where("messages.chat_id = ?", chatID).
+		Where(notExpired, time.Time{}, time.Now()).
+		Order("messages.id desc").
+		Offset(page * legacyPageSize).
+		Limit(legacyPageSize).
+		Find(&messages).Error
+
+	return messages, err
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"server/core/ewc"
+	"server/model/dao"
+
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	ErrInviteNotFound = errors.New("invite not found")
+	ErrInviteExpired  = errors.New("invite is revoked, expired or used up")
+	ErrAlreadyMember  = errors.New("user is a member already")
+)
+
+// DbInviteService - invite links of group chats
+type DbInviteService struct{}
+
+// NewDbInviteService - create invite service
+func NewDbInviteService() *DbInviteService {
+	return new(DbInviteService)
+}
+
+// Create - store invite with hash of new random token, token is returned once
+func (s *DbInviteService) Create(invite dao.ChatInvite) (dao.InviteData, error) {
+	token := NewID()
+	invite.Hash = hashToken(token)
+
+	if err := db.Create(&invite).Error; err != nil {
+		return dao.InviteData{}, err
+	}
+
+	return dao.InviteData{ChatInvite: invite, Token: token}, nil
+}
+
+// GetForChat - invites of chat including used up ones, newest first
+func (s *DbInviteService) GetForChat(chatID int64) []dao.ChatInvite {
+	invites := make([]dao.ChatInvite, 0)
+	db.Where("chat_id = ?", chatID).Order("id desc").Find(&invites)
+
+	return invites
+}
+
+// GetByToken - invite which can be accepted, ErrInviteNotFound or ErrInviteExpired otherwise
+func (s *DbInviteService) GetByToken(token string, now time.Time) (dao.ChatInvite, error) {
+	invite := dao.ChatInvite{}
+	err := db.Where("hash = ?", hashToken(token)).First(&invite).Error
+
+	if gorm.IsRecordNotFoundError(err) {
+		return invite, ErrInviteNotFound
+	}
+	if err != nil {
+		return invite, err
+	}
+	if invite.RevokedAt != nil || !invite.ExpiresAt.After(now) ||
+		(invite.MaxUses > 0 && invite.Uses >= invite.MaxUses) {
+		return invite, ErrInviteExpired
+	}
+
+	return invite, nil
+}
+
+// Revoke - invite of chat can't be accepted anymore, false if there is no such invite
+func (s *DbInviteService) Revoke(chatID int64, id int64, now time.Time) (bool, error) {
+	invite := dao.ChatInvite{}
+	db.Where("id = ? AND chat_id = ?", id, chatID).First(&invite)
+
+	if invite.ID == 0 {
+		return false, nil
+	}
+	if invite.RevokedAt != nil {
+		return true, nil
+	}
+
+	return true, db.Model(&invite).Update("revoked_at", now).Error
+}
+
+// Accept - make user a member of chat of invite and count its use in one transaction.
+// Use is counted only while invite is valid, so concurrent accepts never exceed max uses,
+// and unique index of chat members keeps concurrent accepts of one user from joining twice.
+func (s *DbInviteService) Accept(invite dao.ChatInvite, userID int64, now time.Time) error {
+	tx := db.Begin()
+	result := tx.Model(&dao.ChatInvite{}).
+		Where("id = ? AND revoked_at IS NULL AND expires_at > ? AND (max_uses = 0 OR uses < max_uses)",
+			invite.ID, now).
+		Update("uses", gorm.Expr("uses + 1"))
+
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return ErrInviteExpired
+	}
+
+	members := 0
+	err := tx.Model(&ewc.ChatUser{}).Where("chat_id = ? AND user_id = ?", invite.ChatID, userID).Count(&members).Error
+
+	if err == nil && members == 0 {
+		err = tx.Model(&ewc.Chat{}).Where("id = ? AND owner_id = ?", invite.ChatID, userID).Count(&members).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if members > 0 {
+		tx.Rollback()
+		return ErrAlreadyMember
+	}
+	if err := tx.Create(&ewc.ChatUser{ChatID: invite.ChatID, UserID: userID}).Error; err != nil {
+		tx.Rollback()
+
+		if isMember(invite.ChatID, userID) {
+			return ErrAlreadyMember
+		}
+
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// isMember - user joined chat, for errors of concurrent joins
+func isMember(chatID int64, userID int64) bool {
+	count := 0
+	db.Model(&ewc.ChatUser{}).Where("chat_id = ? AND user_id = ?", chatID, userID).Count(&count)
+
+	return count > 0
+}
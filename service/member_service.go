@@ -0,0 +1,50 @@
+package service
+
+import (
+	"server/core/ewc"
+)
+
+// DbMemberService - membership of users in existing chats
+type DbMemberService struct{}
+
+// NewDbMemberService - create member service
+func NewDbMemberService() *DbMemberService {
+	return new(DbMemberService)
+}
+
+// Add - make user a member of chat
+func (s *DbMemberService) Add(chatID int64, userID int64) error {
+	return db.Create(&ewc.ChatUser{ChatID: chatID, UserID: userID}).Error
+}
+
+// MemberIDs - ids of chat members by single query, owner is a member even without row
+func (s *DbMemberService) MemberIDs(chatID int64) ([]int64, error) {
+	rows, err := db.Raw("SELECT user_id FROM chat_users WHERE chat_id = ? "+
+		"UNION SELECT owner_id FROM chats WHERE id = ?", chatID, chatID).Rows()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	ids := make([]int64, 0)
+
+	for rows.Next() {
+		var id int64
+
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// Remove - user is not a member of chat anymore, false if user wasn't one
+func (s *DbMemberService) Remove(chatID int64, userID int64) (bool, error) {
+	result := db.Where("chat_id = ? AND user_id = ?", chatID, userID).Delete(&ewc.ChatUser{})
+
+	return result.RowsAffected > 0, result.Error
+}
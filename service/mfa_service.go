@@ -0,0 +1,185 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"server/model/dao"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	recoveryCodeCount = 10
+	// maxMfaAttempts - wrong codes allowed for one login with password
+	maxMfaAttempts = 5
+)
+
+var (
+	ErrMfaEnabled        = errors.New("two-factor authentication is already enabled")
+	ErrMfaNotEnrolled    = errors.New("two-factor authentication is not enrolled")
+	ErrChallengeNotFound = errors.New("mfa challenge not found")
+)
+
+// DbMfaService - TOTP secrets, recovery codes and pending logins
+type DbMfaService struct{}
+
+// NewDbMfaService - create mfa service
+func NewDbMfaService() *DbMfaService {
+	return new(DbMfaService)
+}
+
+// Get - TOTP of user, confirmed or not
+func (s *DbMfaService) Get(userID int64) (dao.Mfa, bool) {
+	mfa := dao.Mfa{}
+	db.Where("user_id = ?", userID).First(&mfa)
+
+	return mfa, mfa.ID != 0
+}
+
+// IsEnabled - user has confirmed TOTP
+func (s *DbMfaService) IsEnabled(userID int64) bool {
+	mfa, ok := s.Get(userID)
+
+	return ok && mfa.ConfirmedAt != nil
+}
+
+// Enroll - save new secret, not confirmed enrollment is replaced
+func (s *DbMfaService) Enroll(userID int64, secret string) error {
+	if s.IsEnabled(userID) {
+		return ErrMfaEnabled
+	}
+
+	tx := db.Begin()
+
+	if err := tx.Where("user_id = ?", userID).Delete(&dao.Mfa{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Create(&dao.Mfa{UserID: userID, Secret: secret, CreatedAt: time.Now()}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// Confirm - enable TOTP after first valid code, returns new recovery codes
+func (s *DbMfaService) Confirm(userID int64, step int64) ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	tx := db.Begin()
+	res := tx.Model(&dao.Mfa{}).
+		Where("user_id = ? and confirmed_at is null", userID).
+		Updates(map[string]interface{}{"confirmed_at": time.Now(), "last_step": step})
+
+	if res.Error != nil {
+		tx.Rollback()
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		tx.Rollback()
+		return nil, ErrMfaNotEnrolled
+	}
+	if err := tx.Where("user_id = ?", userID).Delete(&dao.RecoveryCode{}).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for i := 0; i < recoveryCodeCount; i++ {
+		code := newRecoveryCode()
+
+		if err := tx.Create(&dao.RecoveryCode{UserID: userID, Hash: hashRecoveryCode(code)}).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		codes = append(codes, code)
+	}
+
+	return codes, tx.Commit().Error
+}
+
+// UseStep - accept code of step once, codes of the same or earlier step are replays
+func (s *DbMfaService) UseStep(userID int64, step int64) bool {
+	res := db.Model(&dao.Mfa{}).
+		Where("user_id = ? and confirmed_at is not null and last_step < ?", userID, step).
+		Update("last_step", step)
+
+	return res.Error == nil && res.RowsAffected == 1
+}
+
+// UseRecoveryCode - spend recovery code of user
+func (s *DbMfaService) UseRecoveryCode(userID int64, code string) bool {
+	res := db.Model(&dao.RecoveryCode{}).
+		Where("user_id = ? and hash = ? and used_at is null", userID, hashRecoveryCode(code)).
+		Update("used_at", time.Now())
+
+	return res.Error == nil && res.RowsAffected == 1
+}
+
+// Disable - remove TOTP and recovery codes of user
+func (s *DbMfaService) Disable(userID int64) error {
+	tx := db.Begin()
+
+	if err := tx.Where("user_id = ?", userID).Delete(&dao.Mfa{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Where("user_id = ?", userID).Delete(&dao.RecoveryCode{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// CreateChallenge - remember login with password until second factor
+func (s *DbMfaService) CreateChallenge(challenge dao.MfaChallenge) error {
+	return db.Create(&challenge).Error
+}
+
+// GetChallenge - pending login which can still be completed
+func (s *DbMfaService) GetChallenge(jti string, now time.Time) (dao.MfaChallenge, error) {
+	challenge := dao.MfaChallenge{}
+	db.Where("jti = ? and used_at is null and expires_at > ? and attempts < ?", jti, now, maxMfaAttempts).
+		First(&challenge)
+
+	if challenge.ID == 0 {
+		return challenge, ErrChallengeNotFound
+	}
+
+	return challenge, nil
+}
+
+// FailChallenge - count wrong code
+func (s *DbMfaService) FailChallenge(id int64) error {
+	return db.Model(&dao.MfaChallenge{}).
+		Where("id = ?", id).
+		Update("attempts", gorm.Expr("attempts + 1")).Error
+}
+
+// CompleteChallenge - mark login as finished, false when it was finished already
+func (s *DbMfaService) CompleteChallenge(id int64) bool {
+	res := db.Model(&dao.MfaChallenge{}).
+		Where("id = ? and used_at is null", id).
+		Update("used_at", time.Now())
+
+	return res.Error == nil && res.RowsAffected == 1
+}
+
+// DeleteExpiredChallenges - remove logins which can't be completed anymore
+func (s *DbMfaService) DeleteExpiredChallenges(now time.Time) error {
+	return db.Where("expires_at < ?", now).Delete(&dao.MfaChallenge{}).Error
+}
+
+// newRecoveryCode - 20 random hex characters in groups of 5
+func newRecoveryCode() string {
+	code := RandomToken(10)
+
+	return code[:5] + "-" + code[5:10] + "-" + code[10:15] + "-" + code[15:]
+}
+
+// hashRecoveryCode - dashes and case of code are ignored
+func hashRecoveryCode(code string) string {
+	return hashToken(strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1)))
+}
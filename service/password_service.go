@@ -0,0 +1,50 @@
+package service
+
+import (
+	"server/core/ewc"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DbPasswordService - changes passwords of users, core has no method for it
+type DbPasswordService struct {
+	cost int
+}
+
+// NewDbPasswordService - create password service, hashes use bcrypt cost (0 - default)
+func NewDbPasswordService(cost int) *DbPasswordService {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		cost = bcrypt.DefaultCost
+	}
+
+	return &DbPasswordService{cost: cost}
+}
+
+// Change - hash and save passwords of user, empty password is kept
+func (s *DbPasswordService) Change(userID int64, password string, resetPassword string) error {
+	fields := make(map[string]interface{})
+
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), s.cost)
+
+		if err != nil {
+			return err
+		}
+
+		fields["password"] = string(hash)
+	}
+	if resetPassword != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(resetPassword), s.cost)
+
+		if err != nil {
+			return err
+		}
+
+		fields["reset_password"] = string(hash)
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	return db.Model(&ewc.User{}).Where("id = ?", userID).Updates(fields).Error
+}
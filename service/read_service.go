@@ -0,0 +1,111 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"server/model/dao"
+)
+
+// DbReadService - read cursors of chat members
+type DbReadService struct{}
+
+// NewDbReadService - create read cursor service
+func NewDbReadService() *DbReadService {
+	return new(DbReadService)
+}
+
+// GetCursor - read cursor of user in chat, zero cursor if user read nothing
+func (s *DbReadService) GetCursor(chatID int64, userID int64) dao.ReadCursor {
+	cursor := dao.ReadCursor{}
+	db.Where("chat_id = ? and user_id = ?", chatID, userID).First(&cursor)
+
+	if cursor.ID == 0 {
+		cursor.ChatID = chatID
+		cursor.UserID = userID
+	}
+
+	return cursor
+}
+
+// GetChatCursors - read cursors of all members of chat
+func (s *DbReadService) GetChatCursors(chatID int64) []dao.ReadCursor {
+	cursors := make([]dao.ReadCursor, 0)
+	db.Where("chat_id = ?", chatID).Order("user_id").Find(&cursors)
+
+	return cursors
+}
+
+// Advance - move read cursor of user forward, cursor never goes back.
+// Returns actual cursor and whether it was moved.
+func (s *DbReadService) Advance(chatID int64, userID int64, messageID int64) (dao.ReadCursor, bool, error) {
+	cursor := s.GetCursor(chatID, userID)
+
+	if messageID <= cursor.MessageID {
+		return cursor, false, nil
+	}
+	if cursor.ID == 0 {
+		cursor.MessageID = messageID
+		cursor.UpdatedAt = time.Now()
+
+		if err := db.Create(&cursor).Error; err == nil {
+			return cursor, true, nil
+		}
+
+		// cursor was created by concurrent request
+		if cursor = s.GetCursor(chatID, userID); cursor.ID == 0 {
+			return cursor, false, errors.New("can't create read cursor")
+		}
+	}
+
+	// conditional update keeps cursor monotonic under concurrent requests
+	result := db.Model(&dao.ReadCursor{}).
+		Where("id = ? and message_id < ?", cursor.ID, messageID).
+		Updates(map[string]interface{}{"message_id": messageID, "updated_at": time.Now()})
+
+	if result.Error != nil {
+		return cursor, false, result.Error
+	}
+
+	return s.GetCursor(chatID, userID), result.RowsAffected > 0, nil
+}
+
+// GetUnreadCounts - count of messages from other members after read cursor of user, by chat id
+func (s *DbReadService) GetUnreadCounts(userID int64, chatIDs []int64) (map[int64]int, error) {
+	counts := make(map[int64]int, len(chatIDs))
+
+	if len(chatIDs) == 0 {
+		return counts, nil
+	}
+
+	query := `
+		select messages.chat_id, count(messages.id)
+		from messages
+		left join read_cursors on read_cursors.chat_id = messages.chat_id and read_cursors.user_id = ?
+		where messages.chat_id in (?)
+			and messages.user_id <> ?
+			and messages.id > coalesce(read_cursors.message_id, 0)
+			and ` + notExpired + `
+		group by messages.chat_id
+	`
+	rows, err := db.Raw(query, userID, chatIDs, userID, time.Time{}, time.Now()).Rows()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var chatID int64
+		var count int
+
+		if err := rows.Scan(&chatID, &count); err != nil {
+			return nil, err
+		}
+
+		counts[chatID] = count
+	}
+
+	return counts, rows.Err()
+}
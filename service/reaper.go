@@ -0,0 +1,120 @@
+package service
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"server/core/ewc"
+	"server/model/dao"
+)
+
+const (
+	defaultReaperInterval  = 60
+	defaultReaperBatchSize = 500
+)
+
+// MessageReaper - periodically hard-deletes expired messages
+type MessageReaper struct {
+	interval  time.Duration
+	batchSize int
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	once      sync.Once
+}
+
+// NewMessageReaper - create reaper with interval and batch size from config
+func NewMessageReaper(cfg *dao.Config) *MessageReaper {
+	reaper := new(MessageReaper)
+	reaper.interval = time.Duration(cfg.ReaperInterval) * time.Second
+	reaper.batchSize = cfg.ReaperBatchSize
+	reaper.stop = make(chan struct{})
+
+	if cfg.ReaperInterval <= 0 {
+		reaper.interval = defaultReaperInterval * time.Second
+	}
+	if cfg.ReaperBatchSize <= 0 {
+		reaper.batchSize = defaultReaperBatchSize
+	}
+
+	return reaper
+}
+
+// Start - run reaper in background
+func (reaper *MessageReaper) Start() {
+	reaper.wg.Add(1)
+
+	go func() {
+		defer reaper.wg.Done()
+
+		ticker := time.NewTicker(reaper.interval)
+		defer ticker.Stop()
+
+		for {
+			if count, err := reaper.Reap(time.Now()); err != nil {
+				log.Println("reap expired messages error:", err)
+			} else if count > 0 {
+				log.Println("expired messages deleted:", count)
+			}
+			// history of expired, deleted and cleaned messages
+			if err := NewDbRevisionService().DeleteOrphans(); err != nil {
+				log.Println("delete orphan revisions error:", err)
+			}
+			if err := NewDbTokenService().DeleteExpired(time.Now()); err != nil {
+				log.Println("delete expired refresh tokens error:", err)
+			}
+			if err := NewDbMfaService().DeleteExpiredChallenges(time.Now()); err != nil {
+				log.Println("delete expired mfa challenges error:", err)
+			}
+
+			select {
+			case <-reaper.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop - stop reaper and wait for current batch
+func (reaper *MessageReaper) Stop() {
+	reaper.once.Do(func() {
+		close(reaper.stop)
+	})
+	reaper.wg.Wait()
+}
+
+// Reap - delete messages expired before now, returns count of deleted messages
+func (reaper *MessageReaper) Reap(now time.Time) (int, error) {
+	total := 0
+
+	for {
+		ids := make([]int64, 0, reaper.batchSize)
+		err := db.Model(&ewc.Message{}).
+			Where("expired_at > ? and expired_at <= ?", time.Time{}, now).
+			Limit(reaper.batchSize).
+			Pluck("id", &ids).Error
+
+		if err != nil {
+			return total, err
+		}
+		if len(ids) == 0 {
+			return total, nil
+		}
+		if err := db.Unscoped().Where("id in (?)", ids).Delete(&ewc.Message{}).Error; err != nil {
+			return total, err
+		}
+
+		total += len(ids)
+
+		if len(ids) < reaper.batchSize {
+			return total, nil
+		}
+
+		select {
+		case <-reaper.stop:
+			return total, nil
+		default:
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"server/core/ewc"
+	"server/model/dao"
+
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/stretchr/testify/assert"
+)
+
+const reaperConnectionString = "reaper_test.sqlite"
+
+func TestReap(t *testing.T) {
+	cfg := &dao.Config{
+		Driver:           "sqlite3",
+		ConnectionString: reaperConnectionString,
+		ReaperBatchSize:  3,
+	}
+
+	if err := Setup(cfg); err != nil {
+		assert.FailNow(t, "setup error", err.Error())
+	}
+
+	defer os.Remove(reaperConnectionString)
+	defer Close()
+
+	db.AutoMigrate(&ewc.Message{})
+	now := time.Now()
+
+	for i := 0; i < 10; i++ {
+		db.Save(&ewc.Message{ChatID: 1, Text: "expired", ExpiredAt: now.Add(-time.Minute)})
+	}
+
+	db.Save(&ewc.Message{ChatID: 1, Text: "alive", ExpiredAt: now.Add(time.Hour)})
+	db.Save(&ewc.Message{ChatID: 1, Text: "forever"})
+
+	count, err := NewMessageReaper(cfg).Reap(now)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 10, count)
+
+	left := make([]ewc.Message, 0)
+	db.Find(&left)
+
+	assert.Len(t, left, 2)
+}
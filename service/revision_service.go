@@ -0,0 +1,88 @@
+package service
+
+import (
+	"time"
+
+	"server/core/ewc"
+	"server/model/dao"
+)
+
+// DbRevisionService - editing of messages with bounded history
+type DbRevisionService struct{}
+
+// NewDbRevisionService - create revision service
+func NewDbRevisionService() *DbRevisionService {
+	return new(DbRevisionService)
+}
+
+// GetMessage - message by id, expired messages are not found
+func (s *DbRevisionService) GetMessage(id int64) (ewc.Message, error) {
+	msg := ewc.Message{}
+	err := db.Table("messages").
+		Where("messages.id = ?", id).
+		Where(notExpired, time.Time{}, time.Now()).
+		First(&msg).Error
+
+	return msg, err
+}
+
+// Edit - replace text of message keeping previous one in history.
+// Only last limit revisions are kept.
+func (s *DbRevisionService) Edit(msg ewc.Message, text string, limit int) (ewc.Message, dao.MessageRevision, error) {
+	now := time.Now()
+	revision := dao.MessageRevision{
+		MessageID: msg.ID,
+		Text:      msg.Text,
+		EditedAt:  now,
+	}
+	tx := db.Begin()
+
+	if err := tx.Create(&revision).Error; err != nil {
+		tx.Rollback()
+		return msg, revision, err
+	}
+
+	err := tx.Model(&ewc.Message{}).
+		Where("id = ?", msg.ID).
+		Updates(map[string]interface{}{"text": text, "updated_at": now}).Error
+
+	if err != nil {
+		tx.Rollback()
+		return msg, revision, err
+	}
+
+	keep := make([]int64, 0, limit)
+	tx.Model(&dao.MessageRevision{}).
+		Where("message_id = ?", msg.ID).
+		Order("id desc").
+		Limit(limit).
+		Pluck("id", &keep)
+
+	err = tx.Where("message_id = ? and id not in (?)", msg.ID, keep).Delete(&dao.MessageRevision{}).Error
+
+	if err != nil {
+		tx.Rollback()
+		return msg, revision, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return msg, revision, err
+	}
+
+	msg.Text = text
+	msg.UpdatedAt = now
+
+	return msg, revision, nil
+}
+
+// GetRevisions - history of message, newest first
+func (s *DbRevisionService) GetRevisions(messageID int64) []dao.MessageRevision {
+	revisions := make([]dao.MessageRevision, 0)
+	db.Where("message_id = ?", messageID).Order("id desc").Find(&revisions)
+
+	return revisions
+}
+
+// DeleteOrphans - remove history of messages which no longer exist
+func (s *DbRevisionService) DeleteOrphans() error {
+	return db.Where("message_id not in (select id from messages)").Delete(&dao.MessageRevision{}).Error
+}
@@ -0,0 +1,174 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"server/core/ewc"
+	"server/model/dao"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ErrNotOwner - ownership is transferred by current owner only
+var ErrNotOwner = errors.New("user is not owner of chat")
+
+// DbRoleService - roles of chat members. Owner is taken from chat, members without
+// stored role are plain members, in personal chat both users are admins.
+type DbRoleService struct{}
+
+// NewDbRoleService - create role service
+func NewDbRoleService() *DbRoleService {
+	return new(DbRoleService)
+}
+
+// Get - role of user in chat, membership is not checked
+func (s *DbRoleService) Get(chat *ewc.Chat, userID int64) string {
+	if chat.OwnerID == userID {
+		return dao.RoleOwner
+	}
+
+	role := dao.ChatRole{}
+	db.Where("chat_id = ? AND user_id = ?", chat.ID, userID).First(&role)
+
+	switch {
+	case role.Role != "":
+		return role.Role
+	case chat.Personal:
+		return dao.RoleAdmin
+	default:
+		return dao.RoleMember
+	}
+}
+
+// GetForChat - stored roles of chat members
+func (s *DbRoleService) GetForChat(chatID int64) []dao.ChatRole {
+	roles := make([]dao.ChatRole, 0)
+	db.Where("chat_id = ?", chatID).Order("user_id").Find(&roles)
+
+	return roles
+}
+
+// Set - store role of chat member
+func (s *DbRoleService) Set(chatID int64, userID int64, role string) error {
+	item := dao.ChatRole{}
+	db.Where("chat_id = ? AND user_id = ?", chatID, userID).First(&item)
+	item.ChatID = chatID
+	item.UserID = userID
+	item.Role = role
+	item.UpdatedAt = time.Now()
+
+	return db.Save(&item).Error
+}
+
+// Delete - forget role of user who isn't a member anymore
+func (s *DbRoleService) Delete(chatID int64, userID int64) error {
+	return db.Where("chat_id = ? AND user_id = ?", chatID, userID).Delete(&dao.ChatRole{}).Error
+}
+
+// DeleteForChat - forget roles of deleted chat
+func (s *DbRoleService) DeleteForChat(chatID int64) error {
+	return db.Where("chat_id = ?", chatID).Delete(&dao.ChatRole{}).Error
+}
+
+// TransferOwnership - member becomes owner, previous owner stays as admin
+func (s *DbRoleService) TransferOwnership(chatID int64, from int64, to int64) error {
+	tx := db.Begin()
+	result := tx.Model(&ewc.Chat{}).
+		Where("id = ? AND owner_id = ?", chatID, from).
+		Update("owner_id", to)
+
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return ErrNotOwner
+	}
+
+	err := tx.Where("chat_id = ? AND user_id IN (?)", chatID, []int64{from, to}).Delete(&dao.ChatRole{}).Error
+
+	if err == nil {
+		err = tx.Create(&dao.ChatRole{
+			ChatID:    chatID,
+			UserID:    from,
+			Role:      dao.RoleAdmin,
+			UpdatedAt: time.Now(),
+		}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// handOverChats - group chats owned by user get successors and user loses roles in all chats
+func handOverChats(tx *gorm.DB, userID int64) error {
+	owned := make([]ewc.Chat, 0)
+
+	if err := tx.Where("owner_id = ? AND personal = ?", userID, false).Find(&owned).Error; err != nil {
+		return err
+	}
+	for _, chat := range owned {
+		if err := promoteSuccessor(tx, chat.ID, userID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Where("user_id = ?", userID).Delete(&dao.ChatRole{}).Error
+}
+
+// promoteSuccessor - oldest admin, otherwise oldest member who can post, otherwise
+// oldest member becomes owner of chat. Chat without other members keeps its owner.
+func promoteSuccessor(tx *gorm.DB, chatID int64, ownerID int64) error {
+	members := make([]ewc.ChatUser, 0)
+	roles := make([]dao.ChatRole, 0)
+
+	if err := tx.Where("chat_id = ? AND user_id <> ?", chatID, ownerID).Order("id").Find(&members).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("chat_id = ?", chatID).Find(&roles).Error; err != nil {
+		return err
+	}
+	if len(members) == 0 {
+		return nil
+	}
+
+	userRoles := make(map[int64]string)
+
+	for _, role := range roles {
+		userRoles[role.UserID] = role.Role
+	}
+
+	successor := members[0].UserID
+
+	for _, preferred := range []string{dao.RoleAdmin, dao.RoleMember} {
+		found := false
+
+		for _, member := range members {
+			role, ok := userRoles[member.UserID]
+
+			if !ok {
+				role = dao.RoleMember
+			}
+			if role == preferred {
+				successor, found = member.UserID, true
+				break
+			}
+		}
+		if found {
+			break
+		}
+	}
+
+	err := tx.Model(&ewc.Chat{}).Where("id = ?", chatID).Update("owner_id", successor).Error
+
+	if err == nil {
+		err = tx.Where("chat_id = ? AND user_id = ?", chatID, successor).Delete(&dao.ChatRole{}).Error
+	}
+
+	return err
+}
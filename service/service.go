@@ -0,0 +1,56 @@
+package service
+
+import (
+	"log"
+
+	"server/core/ewc"
+	"server/model/dao"
+
+	"github.com/jinzhu/gorm"
+)
+
+var db *gorm.DB
+
+// Setup - open connection for tables owned by server and migrate them
+func Setup(cfg *dao.Config) error {
+	conn, err := gorm.Open(cfg.Driver, cfg.ConnectionString)
+
+	if err != nil {
+		return err
+	}
+
+	Close()
+	db = conn
+	db.AutoMigrate(
+		&dao.ReadCursor{},
+		&dao.ChatSettings{},
+		&dao.ChatRole{},
+		&dao.ChatInvite{},
+		&dao.MessageRevision{},
+		&dao.RefreshToken{},
+		&dao.Session{},
+		&dao.DuressEvent{},
+		&dao.Mfa{},
+		&dao.RecoveryCode{},
+		&dao.MfaChallenge{},
+	)
+
+	// core doesn't prevent double membership, concurrent joins rely on this index
+	if db.HasTable(&ewc.ChatUser{}) {
+		err := db.Model(&ewc.ChatUser{}).AddUniqueIndex("idx_chat_users_chat_user", "chat_id", "user_id").Error
+
+		if err != nil {
+			log.Println("add unique index of chat members error:", err)
+		}
+	}
+
+	return nil
+}
+
+// Close - close connection
+func Close() {
+	if db != nil {
+		db.Close()
+		db = nil
+	}
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"time"
+
+	"server/model/dao"
+)
+
+// touchPeriod - last use time of session is updated not more often than this
+const touchPeriod = time.Minute
+
+// DbSessionService - logins of users on devices
+type DbSessionService struct{}
+
+// NewDbSessionService - create session service
+func NewDbSessionService() *DbSessionService {
+	return new(DbSessionService)
+}
+
+// Create - start session with new token family
+func (s *DbSessionService) Create(session dao.Session) (dao.Session, error) {
+	now := time.Now()
+	session.Family = NewID()
+	session.CreatedAt = now
+	session.LastUsedAt = now
+	err := db.Create(&session).Error
+
+	return session, err
+}
+
+// GetForUser - active sessions of user, recently used first
+func (s *DbSessionService) GetForUser(userID int64) []dao.Session {
+	sessions := make([]dao.Session, 0)
+	db.Where("user_id = ? and revoked_at is null", userID).Order("last_used_at desc").Find(&sessions)
+
+	return sessions
+}
+
+// Get - active session of user by id
+func (s *DbSessionService) Get(userID int64, id int64) (dao.Session, bool) {
+	session := dao.Session{}
+	db.Where("id = ? and user_id = ? and revoked_at is null", id, userID).First(&session)
+
+	return session, session.ID != 0
+}
+
+// GetByFamily - active session of token family
+func (s *DbSessionService) GetByFamily(family string) (dao.Session, bool) {
+	session := dao.Session{}
+	db.Where("family = ? and revoked_at is null", family).First(&session)
+
+	return session, session.ID != 0
+}
+
+// Check - whether session of token family is active, also updates its last use time
+func (s *DbSessionService) Check(family string) bool {
+	session := dao.Session{}
+	db.Where("family = ? and revoked_at is null", family).First(&session)
+
+	if session.ID == 0 {
+		return false
+	}
+
+	now := time.Now()
+
+	if now.Sub(session.LastUsedAt) > touchPeriod {
+		db.Model(&dao.Session{}).Where("id = ?", session.ID).Update("last_used_at", now)
+	}
+
+	return true
+}
+
+// Revoke - end session of token family and revoke its refresh tokens
+func (s *DbSessionService) Revoke(family string) error {
+	err := db.Model(&dao.Session{}).
+		Where("family = ? and revoked_at is null", family).
+		Update("revoked_at", time.Now()).Error
+
+	if err != nil {
+		return err
+	}
+
+	return NewDbTokenService().RevokeFamily(family)
+}
+
+// RevokeUser - end all sessions of user and revoke their refresh tokens,
+// families of ended sessions are returned
+func (s *DbSessionService) RevokeUser(userID int64) ([]string, error) {
+	sessions := make([]dao.Session, 0)
+	db.Where("user_id = ? and revoked_at is null", userID).Find(&sessions)
+
+	return s.revokeAll(sessions)
+}
+
+// RevokeOthers - end all sessions of user except session of token family,
+// families of ended sessions are returned
+func (s *DbSessionService) RevokeOthers(userID int64, family string) ([]string, error) {
+	sessions := make([]dao.Session, 0)
+	db.Where("user_id = ? and family <> ? and revoked_at is null", userID, family).Find(&sessions)
+
+	return s.revokeAll(sessions)
+}
+
+func (s *DbSessionService) revokeAll(sessions []dao.Session) ([]string, error) {
+	families := make([]string, 0, len(sessions))
+
+	for _, session := range sessions {
+		if err := s.Revoke(session.Family); err != nil {
+			return families, err
+		}
+
+		families = append(families, session.Family)
+	}
+
+	return families, nil
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"server/model/dao"
+)
+
+var (
+	ErrTokenNotFound = errors.New("refresh token not found")
+	ErrTokenRevoked  = errors.New("refresh token revoked")
+	ErrTokenReused   = errors.New("refresh token reused")
+)
+
+// DbTokenService - server side store of refresh tokens
+type DbTokenService struct{}
+
+// NewDbTokenService - create refresh token service
+func NewDbTokenService() *DbTokenService {
+	return new(DbTokenService)
+}
+
+// NewID - random identifier for token or family
+func NewID() string {
+	return RandomToken(16)
+}
+
+// Create - remember issued refresh token
+func (s *DbTokenService) Create(userID int64, family string, jti string, expiresAt time.Time) error {
+	return db.Create(&dao.RefreshToken{
+		Jti:       jti,
+		Family:    family,
+		UserID:    userID,
+		ExpiresAt: expiresAt,
+	}).Error
+}
+
+// Use - mark refresh token as used. Second use of token means it was stolen,
+// so the whole family is revoked and ErrTokenReused is returned.
+func (s *DbTokenService) Use(jti string) (dao.RefreshToken, error) {
+	token := dao.RefreshToken{}
+	db.Where("jti = ?", jti).First(&token)
+
+	if token.ID == 0 {
+		return token, ErrTokenNotFound
+	}
+	if token.RevokedAt != nil {
+		return token, ErrTokenRevoked
+	}
+
+	now := time.Now()
+	result := db.Model(&dao.RefreshToken{}).
+		Where("id = ? and used_at is null", token.ID).
+		Update("used_at", now)
+
+	if result.Error != nil {
+		return token, result.Error
+	}
+	if result.RowsAffected == 0 {
+		if err := NewDbSessionService().Revoke(token.Family); err != nil {
+			return token, err
+		}
+
+		return token, ErrTokenReused
+	}
+
+	token.UsedAt = &now
+
+	return token, nil
+}
+
+// RevokeFamily - revoke all tokens issued by rotation from the same login
+func (s *DbTokenService) RevokeFamily(family string) error {
+	return db.Model(&dao.RefreshToken{}).
+		Where("family = ? and revoked_at is null", family).
+		Update("revoked_at", time.Now()).Error
+}
+
+// DeleteExpired - remove tokens which can't be used anymore
+func (s *DbTokenService) DeleteExpired(now time.Time) error {
+	return db.Where("expires_at < ?", now).Delete(&dao.RefreshToken{}).Error
+}
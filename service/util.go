@@ -0,0 +1,28 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// RandomToken - n random bytes in hex, panics when random source fails
+// because nothing secure can be issued without it
+func RandomToken(n int) string {
+	data := make([]byte, n)
+
+	if _, err := rand.Read(data); err != nil {
+		panic("random source error: " + err.Error())
+	}
+
+	return hex.EncodeToString(data)
+}
+
+// hashToken - hash of token to store instead of it. Tokens come from RandomToken
+// with at least 80 bits, they can't be found by search even from leaked hashes,
+// so unsalted fast hash is enough for them.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,58 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// secret of RFC 6238 test vectors, "12345678901234567890"
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+
+	for seconds, expected := range vectors {
+		code, err := Code(rfcSecret, Step(time.Unix(seconds, 0)))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, code)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := Step(now)
+
+	code, _ := Code(rfcSecret, step-1)
+	matched, ok := Validate(rfcSecret, code, now)
+	assert.True(t, ok)
+	assert.Equal(t, step-1, matched)
+
+	code, _ = Code(rfcSecret, step+2)
+	_, ok = Validate(rfcSecret, code, now)
+	assert.False(t, ok)
+
+	_, ok = Validate(rfcSecret, "12345", now)
+	assert.False(t, ok)
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	assert.Nil(t, err)
+	assert.Len(t, secret, 32)
+
+	_, err = Code(secret, 1)
+	assert.Nil(t, err)
+
+	uri := URI("eisenwort", "user 0", secret)
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/eisenwort:user%200?"))
+	assert.Contains(t, uri, "secret="+secret)
+}
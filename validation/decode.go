@@ -0,0 +1,59 @@
+package validation
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+var (
+	ErrBodyTooLarge = errors.New("request body is too large")
+	ErrTrailingData = errors.New("request body has data after JSON value")
+)
+
+// Decode - strict decoding of request body: size is limited, unknown fields and
+// anything after the first JSON value are errors
+func Decode(body io.Reader, maxBytes int64, data interface{}) error {
+	decoder := json.NewDecoder(&limitedReader{reader: body, left: maxBytes})
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(data); err != nil {
+		return err
+	}
+
+	switch err := decoder.Decode(&json.RawMessage{}); err {
+	case io.EOF:
+		return nil
+	case ErrBodyTooLarge:
+		return err
+	default:
+		return ErrTrailingData
+	}
+}
+
+// limitedReader - like io.LimitReader, but reading past the limit is an error, not EOF
+type limitedReader struct {
+	reader io.Reader
+	left   int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		// body of exactly max bytes is fine
+		n, err := l.reader.Read(make([]byte, 1))
+
+		if n > 0 {
+			return 0, ErrBodyTooLarge
+		}
+
+		return 0, err
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+
+	n, err := l.reader.Read(p)
+	l.left -= int64(n)
+
+	return n, err
+}
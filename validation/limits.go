@@ -0,0 +1,98 @@
+package validation
+
+import (
+	"log"
+	"regexp"
+
+	"server/model/dao"
+)
+
+const (
+	DefaultMaxBodyBytes             = 1 << 20
+	DefaultLoginMinLength           = 3
+	DefaultLoginMaxLength           = 32
+	DefaultChatNameMaxLength        = 128
+	DefaultMessageTextMaxLength     = 4096
+	DefaultChatDescriptionMaxLength = 1024
+	// avatar is a reference to image: url or id of upload
+	AvatarMaxLength = 2048
+	AvatarCharset   = `[^\p{Cc}\s]`
+	// letters, digits, space and few separators
+	DefaultLoginCharset = `[\p{L}\p{N} _.-]`
+	// no control characters, emoji joiners and other format characters are fine
+	DefaultChatNameCharset = `[^\p{Cc}]`
+	// same as chat name, but line breaks and tabs are allowed
+	DefaultMessageTextCharset = `[^\p{Cc}]|[\n\r\t]`
+)
+
+// Limits - limits of user input, zero values of config are replaced by defaults
+type Limits struct {
+	MaxBodyBytes int64
+	Login        Limit
+	ChatName     Limit
+	MessageText  Limit
+	// optional fields
+	ChatDescription Limit
+	Avatar          Limit
+}
+
+// NewLimits - limits from config, invalid charset is logged and replaced by default
+func NewLimits(cfg *dao.Config) Limits {
+	maxBodyBytes := cfg.MaxBodyBytes
+
+	if maxBodyBytes <= 0 {
+		maxBodyBytes = DefaultMaxBodyBytes
+	}
+
+	messageTextCharset := charset("message text", cfg.MessageTextCharset, DefaultMessageTextCharset)
+
+	return Limits{
+		MaxBodyBytes: maxBodyBytes,
+		Login: Limit{
+			Min:     orDefault(cfg.LoginMinLength, DefaultLoginMinLength),
+			Max:     orDefault(cfg.LoginMaxLength, DefaultLoginMaxLength),
+			Charset: charset("login", cfg.LoginCharset, DefaultLoginCharset),
+		},
+		ChatName: Limit{
+			Min:     1,
+			Max:     orDefault(cfg.ChatNameMaxLength, DefaultChatNameMaxLength),
+			Charset: charset("chat name", cfg.ChatNameCharset, DefaultChatNameCharset),
+		},
+		MessageText: Limit{
+			Min:     1,
+			Max:     orDefault(cfg.MessageTextMaxLength, DefaultMessageTextMaxLength),
+			Charset: messageTextCharset,
+		},
+		ChatDescription: Limit{
+			Max:     orDefault(cfg.ChatDescriptionMaxLength, DefaultChatDescriptionMaxLength),
+			Charset: messageTextCharset,
+		},
+		Avatar: Limit{
+			Max:     AvatarMaxLength,
+			Charset: charset("avatar", "", AvatarCharset),
+		},
+	}
+}
+
+// charset - whole value matches when it consists of characters of class
+func charset(name string, class string, def string) *regexp.Regexp {
+	if class != "" {
+		re, err := regexp.Compile(`^(?:` + class + `)*$`)
+
+		if err == nil {
+			return re
+		}
+
+		log.Println("invalid", name, "charset, default is used:", err)
+	}
+
+	return regexp.MustCompile(`^(?:` + def + `)*$`)
+}
+
+func orDefault(value int, def int) int {
+	if value <= 0 {
+		return def
+	}
+
+	return value
+}
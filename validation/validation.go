@@ -0,0 +1,72 @@
+package validation
+
+import (
+	"fmt"
+	"regexp"
+	"unicode/utf8"
+
+	"server/model/dao"
+)
+
+// Limit - allowed length in characters and charset of text field
+type Limit struct {
+	Min int
+	// zero is no limit
+	Max int
+	// every character has to match, nil allows any
+	Charset *regexp.Regexp
+}
+
+// Required - field has to be present, its content is not checked
+var Required = Limit{Min: 1}
+
+// Optional - same limit, but empty value is valid
+func (limit Limit) Optional() Limit {
+	limit.Min = 0
+
+	return limit
+}
+
+// Rule - value of request field checked against limit
+type Rule struct {
+	Field string
+	Value string
+	Limit Limit
+}
+
+// Check - errors of every broken rule, one error per field at most
+func Check(rules ...Rule) []dao.FieldError {
+	fields := make([]dao.FieldError, 0)
+
+	for _, rule := range rules {
+		if field, ok := rule.check(); !ok {
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+func (rule Rule) check() (dao.FieldError, bool) {
+	limit := rule.Limit
+	field := dao.FieldError{Field: rule.Field}
+	length := utf8.RuneCountInString(rule.Value)
+
+	switch {
+	case length == 0 && limit.Min > 0:
+		field.Code = dao.FieldRequired
+	case limit.Charset != nil && !limit.Charset.MatchString(rule.Value):
+		field.Code = dao.FieldInvalid
+		field.Message = "contains characters which are not allowed"
+	case length < limit.Min:
+		field.Code = dao.FieldTooShort
+		field.Message = fmt.Sprintf("must have at least %d characters", limit.Min)
+	case limit.Max > 0 && length > limit.Max:
+		field.Code = dao.FieldTooLong
+		field.Message = fmt.Sprintf("must have at most %d characters", limit.Max)
+	default:
+		return field, true
+	}
+
+	return field, false
+}
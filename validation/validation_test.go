@@ -0,0 +1,78 @@
+package validation
+
+import (
+	"strings"
+	"testing"
+
+	"server/model/dao"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	limits := NewLimits(&dao.Config{})
+
+	assert.Empty(t, Check(
+		Rule{Field: "login", Value: "user_0", Limit: limits.Login},
+		Rule{Field: "name", Value: "чат 👨‍👩‍👧", Limit: limits.ChatName},
+		Rule{Field: "text", Value: "line\nline\ttab", Limit: limits.MessageText},
+		Rule{Field: "password", Value: "\x01any", Limit: Required},
+		Rule{Field: "name", Value: "", Limit: limits.ChatName.Optional()},
+	))
+
+	// every broken rule is listed in order
+	fields := Check(
+		Rule{Field: "login", Value: "ab", Limit: limits.Login},
+		Rule{Field: "name", Value: "bad\x00name", Limit: limits.ChatName},
+		Rule{Field: "text", Value: "", Limit: limits.MessageText},
+		Rule{Field: "long", Value: strings.Repeat("я", DefaultMessageTextMaxLength+1), Limit: limits.MessageText},
+		Rule{Field: "charset", Value: "user@0", Limit: limits.Login},
+	)
+
+	assert.Len(t, fields, 5)
+	assert.Equal(t, dao.FieldError{Field: "login", Code: dao.FieldTooShort, Message: "must have at least 3 characters"}, fields[0])
+	assert.Equal(t, dao.FieldInvalid, fields[1].Code)
+	assert.Equal(t, dao.FieldError{Field: "text", Code: dao.FieldRequired}, fields[2])
+	assert.Equal(t, dao.FieldTooLong, fields[3].Code)
+	assert.Equal(t, dao.FieldInvalid, fields[4].Code)
+
+	// length is counted in characters, not bytes
+	assert.Empty(t, Check(Rule{Field: "text", Value: strings.Repeat("я", DefaultMessageTextMaxLength), Limit: limits.MessageText}))
+}
+
+func TestNewLimits(t *testing.T) {
+	limits := NewLimits(&dao.Config{
+		MaxBodyBytes:      100,
+		LoginMinLength:    5,
+		LoginMaxLength:    6,
+		LoginCharset:      `[a-z]`,
+		ChatNameCharset:   `[`,
+		ChatNameMaxLength: 2,
+	})
+
+	assert.Equal(t, int64(100), limits.MaxBodyBytes)
+	assert.Equal(t, Limit{Min: 5, Max: 6, Charset: limits.Login.Charset}, limits.Login)
+	assert.Empty(t, Check(Rule{Field: "login", Value: "abcde", Limit: limits.Login}))
+	assert.Len(t, Check(Rule{Field: "login", Value: "abcd1", Limit: limits.Login}), 1)
+
+	// invalid charset is replaced by default
+	assert.Empty(t, Check(Rule{Field: "name", Value: "ok", Limit: limits.ChatName}))
+	assert.Len(t, Check(Rule{Field: "name", Value: "o\x00", Limit: limits.ChatName}), 1)
+	assert.Equal(t, DefaultMessageTextMaxLength, limits.MessageText.Max)
+}
+
+func TestDecode(t *testing.T) {
+	data := struct {
+		Text string `json:"text"`
+	}{}
+
+	assert.Nil(t, Decode(strings.NewReader(`{"text": "abc"}`+"\n"), 16, &data))
+	assert.Equal(t, "abc", data.Text)
+
+	assert.Equal(t, ErrBodyTooLarge, Decode(strings.NewReader(`{"text": "abcd"}`), 15, &data))
+	assert.Equal(t, ErrBodyTooLarge, Decode(strings.NewReader(`{"text": "abc"}  {}`), 16, &data))
+	assert.Equal(t, ErrTrailingData, Decode(strings.NewReader(`{"text": "abc"} {}`), 100, &data))
+	assert.Equal(t, ErrTrailingData, Decode(strings.NewReader(`{"text": "abc"}]`), 100, &data))
+	assert.NotNil(t, Decode(strings.NewReader(`{"text": "abc", "other": 1}`), 100, &data))
+	assert.NotNil(t, Decode(strings.NewReader(``), 100, &data))
+}